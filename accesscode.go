@@ -0,0 +1,53 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const accessCodeLength = 20
+
+var (
+	ErrAccessCodeLength       = errors.Errorf("access code must be exactly %d digits", accessCodeLength)
+	ErrAccessCodeNotNumeric   = errors.New("access code must only contain decimal digits")
+	ErrAccessCodeGarbage      = errors.New("access code looks like a placeholder, not a real card")
+	ErrAccessCodeUnregistered = errors.New("access code is not registered in record.txt")
+)
+
+// ValidateAccessCode checks that code is a plausible AIME access code: 20
+// decimal digits that are not all the same digit or a simple ascending or
+// descending run. When registry is not nil, code must also belong to a card
+// in it.
+func ValidateAccessCode(code string, registry *CardRegistry) error {
+	if len(code) != accessCodeLength {
+		return ErrAccessCodeLength
+	}
+
+	for _, ch := range code {
+		if ch < '0' || ch > '9' {
+			return ErrAccessCodeNotNumeric
+		}
+	}
+
+	if strings.Count(code, code[:1]) == len(code) || isDigitRun(code, 1) || isDigitRun(code, -1) {
+		return ErrAccessCodeGarbage
+	}
+
+	if registry != nil && !registry.HasCard(code) {
+		return ErrAccessCodeUnregistered
+	}
+
+	return nil
+}
+
+// isDigitRun reports whether every digit of code is the previous one plus
+// step, wrapping around at 9 and 0 (e.g. 01234567890123456789).
+func isDigitRun(code string, step int) bool {
+	for i := 1; i < len(code); i++ {
+		if (int(code[i-1]-'0')+step+10)%10 != int(code[i]-'0') {
+			return false
+		}
+	}
+	return true
+}
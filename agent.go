@@ -0,0 +1,441 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+	"github.com/samber/lo"
+	"github.com/urfave/cli/v2"
+)
+
+// The server and its agents exchange JSON agentMessages over a WebSocket at
+// agentPath. The agent opens the connection with the shared token as a
+// Bearer token and introduces itself with a hello. It then sends a status
+// every agentStatusInterval and answers read and write requests with a
+// result carrying the request's ID.
+const (
+	agentPath = "/agent"
+
+	agentStatusInterval = 15 * time.Second
+	agentCallTimeout    = 10 * time.Second
+	agentWriteTimeout   = 10 * time.Second
+	agentReconnectDelay = 5 * time.Second
+)
+
+// agentReadTimeout drops an agent that missed a few status messages.
+const agentReadTimeout = 3 * agentStatusInterval
+
+const (
+	agentMessageHello  = "hello"
+	agentMessageStatus = "status"
+	agentMessageRead   = "read"
+	agentMessageWrite  = "write"
+	agentMessageResult = "result"
+)
+
+type agentMessage struct {
+	Type  string `json:"type"`
+	ID    uint64 `json:"id,omitempty"`
+	Agent string `json:"agent,omitempty"`
+	Card  string `json:"card,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// agentWire serialises writes to a WebSocket, which allows only one writer
+// at a time.
+type agentWire struct {
+	ws *websocket.Conn
+	mu sync.Mutex
+}
+
+func (w *agentWire) send(msg *agentMessage) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := w.ws.SetWriteDeadline(time.Now().Add(agentWriteTimeout)); err != nil {
+		return err
+	}
+	return w.ws.WriteJSON(msg)
+}
+
+// AgentHub accepts agent connections and routes requests to them by name.
+type AgentHub struct {
+	token string
+
+	upgrader websocket.Upgrader
+	nextID   atomic.Uint64
+
+	mu     sync.Mutex
+	agents map[string]*agentConn
+}
+
+type agentConn struct {
+	name string
+	wire *agentWire
+
+	mu       sync.Mutex
+	pending  map[uint64]chan *agentMessage
+	card     string
+	health   string
+	lastSeen time.Time
+}
+
+func NewAgentHub(token string) *AgentHub {
+	return &AgentHub{
+		token:  token,
+		agents: make(map[string]*agentConn),
+	}
+}
+
+// Start listens for agents on addr until ctx is done.
+func (h *AgentHub) Start(ctx context.Context, addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return errors.Wrap(err, "failed to listen for agents")
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(agentPath, h)
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	go func() {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			log.Println("agent hub: server stopped:", err)
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		if err := srv.Close(); err != nil {
+			log.Println("agent hub: failed to close server:", err)
+		}
+		h.closeAll()
+	}()
+
+	log.Println("agent hub: listening on", ln.Addr())
+	return nil
+}
+
+func (h *AgentHub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !hasBearerToken(r, h.token) {
+		log.Println("agent hub: rejected unauthorized connection from", r.RemoteAddr)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	ws, err := h.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println("agent hub: failed to upgrade connection from", r.RemoteAddr, ":", err)
+		return
+	}
+	defer ws.Close()
+
+	if err := ws.SetReadDeadline(time.Now().Add(agentReadTimeout)); err != nil {
+		return
+	}
+	var hello agentMessage
+	if err := ws.ReadJSON(&hello); err != nil || hello.Type != agentMessageHello || hello.Agent == "" {
+		log.Println("agent hub: connection from", r.RemoteAddr, "did not say hello")
+		return
+	}
+
+	conn := &agentConn{
+		name:     hello.Agent,
+		wire:     &agentWire{ws: ws},
+		pending:  make(map[uint64]chan *agentMessage),
+		card:     hello.Card,
+		health:   hello.Error,
+		lastSeen: time.Now(),
+	}
+	h.register(conn)
+	defer h.unregister(conn)
+
+	log.Println("agent hub:", conn.name, "connected from", r.RemoteAddr, "with card", redactedCardNum(conn.card))
+
+	for {
+		if err := ws.SetReadDeadline(time.Now().Add(agentReadTimeout)); err != nil {
+			return
+		}
+		var msg agentMessage
+		if err := ws.ReadJSON(&msg); err != nil {
+			log.Println("agent hub:", conn.name, "disconnected:", err)
+			return
+		}
+		conn.receive(&msg)
+	}
+}
+
+// register makes conn the connection of its agent, replacing an older one.
+func (h *AgentHub) register(conn *agentConn) {
+	h.mu.Lock()
+	prev := h.agents[conn.name]
+	h.agents[conn.name] = conn
+	h.mu.Unlock()
+
+	if prev != nil {
+		log.Println("agent hub:", conn.name, "reconnected, dropping the previous connection")
+		prev.wire.ws.Close()
+	}
+}
+
+func (h *AgentHub) unregister(conn *agentConn) {
+	h.mu.Lock()
+	if h.agents[conn.name] == conn {
+		delete(h.agents, conn.name)
+	}
+	h.mu.Unlock()
+
+	conn.failPending()
+}
+
+func (h *AgentHub) closeAll() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, conn := range h.agents {
+		conn.wire.ws.Close()
+	}
+}
+
+// Call sends msg to the agent called name and waits for its result.
+func (h *AgentHub) Call(ctx context.Context, name string, msg *agentMessage) (*agentMessage, error) {
+	h.mu.Lock()
+	conn, ok := h.agents[name]
+	h.mu.Unlock()
+	if !ok {
+		return nil, errors.Errorf("agent %q is not connected", name)
+	}
+
+	msg.ID = h.nextID.Add(1)
+	reply := make(chan *agentMessage, 1)
+	conn.mu.Lock()
+	conn.pending[msg.ID] = reply
+	conn.mu.Unlock()
+	defer func() {
+		conn.mu.Lock()
+		delete(conn.pending, msg.ID)
+		conn.mu.Unlock()
+	}()
+
+	if err := conn.wire.send(msg); err != nil {
+		return nil, errors.Wrapf(err, "failed to send %s to agent %q", msg.Type, name)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, agentCallTimeout)
+	defer cancel()
+
+	select {
+	case <-ctx.Done():
+		return nil, errors.Wrapf(ctx.Err(), "agent %q did not answer %s", name, msg.Type)
+	case res, ok := <-reply:
+		if !ok {
+			return nil, errors.Errorf("agent %q disconnected during %s", name, msg.Type)
+		}
+		if res.Error != "" {
+			return nil, errors.Errorf("agent %q: %s", name, res.Error)
+		}
+		return res, nil
+	}
+}
+
+// AgentStatus is what an agent last reported about its cab.
+type AgentStatus struct {
+	Agent     string `json:"agent"`
+	Connected bool   `json:"connected"`
+	// Card is the redacted card in the agent's aime.txt.
+	Card string `json:"card,omitempty"`
+	// Health is the agent's problem reading aime.txt, empty if it has none.
+	Health   string     `json:"health,omitempty"`
+	LastSeen *time.Time `json:"lastSeen,omitempty"`
+}
+
+// Problem describes what is wrong with the agent, or "" if nothing is.
+func (s *AgentStatus) Problem() string {
+	switch {
+	case !s.Connected:
+		return fmt.Sprintf("agent %s is not connected", s.Agent)
+	case s.Health != "":
+		return fmt.Sprintf("agent %s: %s", s.Agent, s.Health)
+	}
+	return ""
+}
+
+// Status returns the last status of the agent called name.
+func (h *AgentHub) Status(name string) *AgentStatus {
+	h.mu.Lock()
+	conn, ok := h.agents[name]
+	h.mu.Unlock()
+	if !ok {
+		return &AgentStatus{Agent: name}
+	}
+
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	return &AgentStatus{
+		Agent:     name,
+		Connected: true,
+		Card:      redactedCardNum(conn.card),
+		Health:    conn.health,
+		LastSeen:  lo.ToPtr(conn.lastSeen),
+	}
+}
+
+func (c *agentConn) receive(msg *agentMessage) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.lastSeen = time.Now()
+	switch msg.Type {
+	case agentMessageStatus:
+		if msg.Error != c.health {
+			if msg.Error != "" {
+				log.Println("agent hub:", c.name, "reports a problem:", msg.Error)
+			} else {
+				log.Println("agent hub:", c.name, "is healthy again")
+			}
+		}
+		c.card, c.health = msg.Card, msg.Error
+	case agentMessageResult:
+		if reply, ok := c.pending[msg.ID]; ok {
+			reply <- msg
+			delete(c.pending, msg.ID)
+		}
+	default:
+		log.Println("agent hub:", c.name, "sent unexpected message", msg.Type)
+	}
+}
+
+// failPending wakes up every call still waiting on a result.
+func (c *agentConn) failPending() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for id, reply := range c.pending {
+		close(reply)
+		delete(c.pending, id)
+	}
+}
+
+// Agent runs on a cab PC and applies the server's requests to the local
+// aime.txt.
+type Agent struct {
+	name      string
+	serverURL string
+	token     string
+	aime      *LocalAimeTxt
+}
+
+// RunAgent is the action of the agent command. It keeps a connection to the
+// server open, reconnecting after failures, until the process is stopped.
+func RunAgent(c *cli.Context) error {
+	a := &Agent{
+		name:      c.String("agent-name"),
+		serverURL: c.String("server-url"),
+		token:     c.String("agent-token"),
+		aime:      NewLocalAimeTxt(c.Path("aimetxt-path")),
+	}
+
+	ctx := c.Context
+	for {
+		err := a.serve(ctx)
+		if ctx.Err() != nil {
+			log.Println("Shutting down:", context.Cause(ctx))
+			return nil
+		}
+
+		log.Println("agent: connection lost:", err, "- reconnecting in", agentReconnectDelay)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(agentReconnectDelay):
+		}
+	}
+}
+
+// status describes the current card and whether aime.txt can be read.
+func (a *Agent) status(typ string) *agentMessage {
+	msg := &agentMessage{Type: typ, Agent: a.name}
+	card, err := a.aime.Read(context.Background())
+	if err != nil {
+		msg.Error = err.Error()
+	}
+	msg.Card = card
+	return msg
+}
+
+func (a *Agent) serve(ctx context.Context) error {
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+a.token)
+
+	ws, resp, err := websocket.DefaultDialer.DialContext(ctx, a.serverURL, header)
+	if err != nil {
+		if resp != nil {
+			return errors.Wrapf(err, "server responded with %s", resp.Status)
+		}
+		return errors.Wrap(err, "failed to connect to server")
+	}
+	defer ws.Close()
+
+	wire := &agentWire{ws: ws}
+	if err := wire.send(a.status(agentMessageHello)); err != nil {
+		return errors.Wrap(err, "failed to send hello")
+	}
+	log.Println("agent: connected to", a.serverURL, "as", a.name)
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				ws.Close()
+				return
+			case <-done:
+				return
+			case <-time.After(agentStatusInterval):
+			}
+
+			if err := wire.send(a.status(agentMessageStatus)); err != nil {
+				log.Println("agent: failed to send status:", err)
+			}
+		}
+	}()
+
+	for {
+		var msg agentMessage
+		if err := ws.ReadJSON(&msg); err != nil {
+			return err
+		}
+
+		res := &agentMessage{Type: agentMessageResult, ID: msg.ID}
+		switch msg.Type {
+		case agentMessageRead:
+			res.Card, err = a.aime.Read(ctx)
+		case agentMessageWrite:
+			if err = ValidateAccessCode(msg.Card, nil); err == nil {
+				err = a.aime.Write(ctx, msg.Card)
+			}
+			if err == nil {
+				log.Println("agent: switched aime.txt to", redactedCardNum(msg.Card))
+			}
+		default:
+			err = errors.Errorf("unknown request %q", msg.Type)
+		}
+		if err != nil {
+			log.Println("agent:", msg.Type, "failed:", err)
+			res.Error = err.Error()
+		}
+
+		if err := wire.send(res); err != nil {
+			return errors.Wrap(err, "failed to send result")
+		}
+	}
+}
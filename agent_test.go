@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestAgentLoopback runs an AgentHub and an Agent against each other over a
+// local WebSocket and switches the agent's aime.txt through the hub.
+func TestAgentLoopback(t *testing.T) {
+	const (
+		token     = "agent-secret"
+		name      = "test-cab"
+		startCard = "12340000000000005678"
+		nextCard  = "98760000000000004321"
+	)
+
+	aimePath := filepath.Join(t.TempDir(), "aime.txt")
+	if err := os.WriteFile(aimePath, []byte(startCard), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	hub := NewAgentHub(token)
+	srv := httptest.NewServer(hub)
+	defer srv.Close()
+	serverURL := "ws" + strings.TrimPrefix(srv.URL, "http") + agentPath
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	agent := &Agent{name: name, serverURL: serverURL, token: token, aime: NewLocalAimeTxt(aimePath)}
+	served := make(chan error, 1)
+	go func() { served <- agent.serve(ctx) }()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !hub.Status(name).Connected {
+		if time.Now().After(deadline) {
+			t.Fatal("agent did not connect")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	status := hub.Status(name)
+	if status.Card != redactedCardNum(startCard) || status.Problem() != "" {
+		t.Errorf("status after hello = %+v", status)
+	}
+
+	remote := NewRemoteAimeTxt(hub, name)
+	if card, err := remote.Read(ctx); err != nil || card != startCard {
+		t.Errorf("Read() = %q, %v, want %q", card, err, startCard)
+	}
+
+	if err := remote.Write(ctx, nextCard); err != nil {
+		t.Fatalf("Write() = %v", err)
+	}
+	if b, _ := os.ReadFile(aimePath); string(b) != nextCard {
+		t.Errorf("aime.txt = %q after write, want %q", b, nextCard)
+	}
+
+	if err := remote.Write(ctx, "123"); err == nil {
+		t.Error("Write() of an invalid card succeeded")
+	}
+	if b, _ := os.ReadFile(aimePath); string(b) != nextCard {
+		t.Errorf("aime.txt = %q after rejected write, want %q", b, nextCard)
+	}
+
+	cancel()
+	select {
+	case <-served:
+	case <-time.After(5 * time.Second):
+		t.Fatal("agent did not stop")
+	}
+	for deadline = time.Now().Add(5 * time.Second); hub.Status(name).Connected; {
+		if time.Now().After(deadline) {
+			t.Fatal("hub still lists the stopped agent")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if problem := hub.Status(name).Problem(); problem == "" {
+		t.Error("disconnected agent reports no problem")
+	}
+}
+
+func TestAgentRejectsWrongToken(t *testing.T) {
+	hub := NewAgentHub("agent-secret")
+	srv := httptest.NewServer(hub)
+	defer srv.Close()
+
+	agent := &Agent{
+		name:      "test-cab",
+		serverURL: "ws" + strings.TrimPrefix(srv.URL, "http") + agentPath,
+		token:     "wrong",
+		aime:      NewLocalAimeTxt(filepath.Join(t.TempDir(), "aime.txt")),
+	}
+	err := agent.serve(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("serve() with a wrong token = %v, want a 401 error", err)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// AimeTxt is the aime.txt of a cabinet, either a local file or one owned by
+// a remote agent.
+type AimeTxt interface {
+	// Read returns the active access code. A missing file yields "".
+	Read(ctx context.Context) (string, error)
+	Write(ctx context.Context, cardNum string) error
+}
+
+// LocalAimeTxt is an aime.txt on this machine.
+type LocalAimeTxt struct {
+	path string
+}
+
+func NewLocalAimeTxt(path string) *LocalAimeTxt {
+	return &LocalAimeTxt{path: path}
+}
+
+func (a *LocalAimeTxt) Read(ctx context.Context) (string, error) {
+	b, err := os.ReadFile(a.path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", errors.Wrap(err, "failed to read from aime.txt")
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+func (a *LocalAimeTxt) Write(ctx context.Context, cardNum string) error {
+	return errors.Wrap(os.WriteFile(a.path, []byte(cardNum), 0o644), "failed to write to aime.txt")
+}
+
+// RemoteAimeTxt is the aime.txt of the agent called name, reached through
+// hub.
+type RemoteAimeTxt struct {
+	hub  *AgentHub
+	name string
+}
+
+func NewRemoteAimeTxt(hub *AgentHub, name string) *RemoteAimeTxt {
+	return &RemoteAimeTxt{hub: hub, name: name}
+}
+
+// Status returns what the agent last reported.
+func (a *RemoteAimeTxt) Status() *AgentStatus {
+	return a.hub.Status(a.name)
+}
+
+func (a *RemoteAimeTxt) Read(ctx context.Context) (string, error) {
+	reply, err := a.hub.Call(ctx, a.name, &agentMessage{Type: agentMessageRead})
+	if err != nil {
+		return "", err
+	}
+	return reply.Card, nil
+}
+
+func (a *RemoteAimeTxt) Write(ctx context.Context, cardNum string) error {
+	_, err := a.hub.Call(ctx, a.name, &agentMessage{Type: agentMessageWrite, Card: cardNum})
+	return err
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/pkg/errors"
+)
+
+// maxAPIBodySize bounds request bodies of the HTTP API.
+const maxAPIBodySize = 64 << 10
+
+// APIServer is the HTTP/JSON control API. It works without Discord, e.g. for
+// a kiosk tablet next to the cab. Every request needs the API token as a
+// Bearer token; token holders are trusted like admins and bypass the card
+// policies.
+//
+//	GET  /api/v1/cabinets               with the status of each cabinet's agent
+//	GET  /api/v1/cards?cabinet=<name>
+//	GET  /api/v1/current?cabinet=<name>
+//	POST /api/v1/switch?cabinet=<name>  {"name": "<player>"} or {"card": "<access code>"}
+//	GET  /api/v1/events                 server-sent events for the dashboard
+//
+// The cabinet parameter defaults to the first cabinet. As browsers cannot
+// set headers on an EventSource, the token may also be passed as ?token=.
+// The dashboard's static files are served from / without a token.
+type APIServer struct {
+	token     string
+	svc       *CardService
+	dashboard *Dashboard
+}
+
+func NewAPIServer(token string, svc *CardService, dashboard *Dashboard) *APIServer {
+	return &APIServer{token: token, svc: svc, dashboard: dashboard}
+}
+
+// hasBearerToken reports whether r carries token as its Bearer token. An
+// empty token matches no request.
+func hasBearerToken(r *http.Request, token string) bool {
+	got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && token != "" && subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+}
+
+// Start serves the API on addr until ctx is done.
+func (a *APIServer) Start(ctx context.Context, addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return errors.Wrap(err, "failed to listen for api requests")
+	}
+
+	srv := &http.Server{
+		Handler:           a.Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+		// End event streams on shutdown.
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+
+	go func() {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			log.Println("api: server stopped:", err)
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			log.Println("api: failed to shut down server:", err)
+		}
+	}()
+
+	log.Println("api: listening on", ln.Addr())
+	return nil
+}
+
+// apiError is an error with the HTTP status it is reported with.
+type apiError struct {
+	status int
+	err    error
+}
+
+func (e *apiError) Error() string {
+	return e.err.Error()
+}
+
+type apiHandlerFunc func(r *http.Request) (interface{}, error)
+
+func (a *APIServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/api/v1/cabinets", a.handle(http.MethodGet, a.listCabinets))
+	mux.Handle("/api/v1/cards", a.handle(http.MethodGet, a.listCards))
+	mux.Handle("/api/v1/current", a.handle(http.MethodGet, a.current))
+	mux.Handle("/api/v1/switch", a.handle(http.MethodPost, a.switchCard))
+	mux.HandleFunc("/api/v1/events", func(w http.ResponseWriter, r *http.Request) {
+		if !a.authorized(r) {
+			http.Error(w, "missing or invalid token", http.StatusUnauthorized)
+			return
+		}
+		a.dashboard.ServeEvents(w, r)
+	})
+	mux.Handle("/", a.dashboard.StaticHandler())
+	return mux
+}
+
+func (a *APIServer) authorized(r *http.Request) bool {
+	if token := r.URL.Query().Get("token"); token != "" {
+		return subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) == 1
+	}
+	return hasBearerToken(r, a.token)
+}
+
+// handle checks the method and token, and writes fn's result or error as
+// JSON.
+func (a *APIServer) handle(method string, fn apiHandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body interface{}
+		var err error
+		switch {
+		case !a.authorized(r):
+			err = &apiError{http.StatusUnauthorized, errors.New("missing or invalid token")}
+		case r.Method != method:
+			err = &apiError{http.StatusMethodNotAllowed, errors.Errorf("use %s", method)}
+		default:
+			body, err = fn(r)
+		}
+
+		status := http.StatusOK
+		if err != nil {
+			status = http.StatusInternalServerError
+			if apiErr, ok := err.(*apiError); ok {
+				status = apiErr.status
+			}
+			if status == http.StatusInternalServerError {
+				log.Println("api:", r.Method, r.URL.Path, "failed:", err)
+			}
+			body = map[string]string{"error": err.Error()}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		if err := json.NewEncoder(w).Encode(body); err != nil {
+			log.Println("api: failed to write response:", err)
+		}
+	})
+}
+
+func (a *APIServer) cabinet(r *http.Request) (*Cabinet, error) {
+	name := r.URL.Query().Get("cabinet")
+	if name == "" {
+		return cabinets.Default(""), nil
+	}
+	cab, ok := cabinets.Get(name)
+	if !ok {
+		return nil, &apiError{http.StatusNotFound, errors.Errorf("unknown cabinet %q", name)}
+	}
+	return cab, nil
+}
+
+type apiCabinet struct {
+	Name  string       `json:"name"`
+	Game  string       `json:"game"`
+	Place string       `json:"place"`
+	Agent *AgentStatus `json:"agent,omitempty"`
+}
+
+type apiCard struct {
+	Name    string `json:"name"`
+	CardNum string `json:"cardNum"`
+}
+
+type apiCurrent struct {
+	Cabinet  string `json:"cabinet"`
+	CardNum  string `json:"cardNum"`
+	CardName string `json:"cardName"`
+}
+
+type apiSwitchRequest struct {
+	// Name is a player in record.txt; Card an access code. Exactly one is
+	// needed.
+	Name string `json:"name"`
+	Card string `json:"card"`
+	// By is recorded in the switch history, e.g. "kiosk".
+	By string `json:"by"`
+}
+
+func (a *APIServer) listCabinets(r *http.Request) (interface{}, error) {
+	list := make([]apiCabinet, 0, len(cabinets.All()))
+	for _, cab := range cabinets.All() {
+		list = append(list, apiCabinet{Name: cab.Name, Game: cab.Game, Place: cab.Place, Agent: cab.AgentStatus()})
+	}
+	return list, nil
+}
+
+// listCards returns the registered cards with redacted access codes, like
+// /card list.
+func (a *APIServer) listCards(r *http.Request) (interface{}, error) {
+	cab, err := a.cabinet(r)
+	if err != nil {
+		return nil, err
+	}
+
+	registered := a.svc.Cards(cab)
+	list := make([]apiCard, 0, len(registered))
+	for _, card := range registered {
+		list = append(list, apiCard{Name: card.Name, CardNum: redactedCardNum(card.CardNum)})
+	}
+	return list, nil
+}
+
+func (a *APIServer) current(r *http.Request) (interface{}, error) {
+	cab, err := a.cabinet(r)
+	if err != nil {
+		return nil, err
+	}
+
+	cardNum, cardName, err := a.svc.Current(r.Context(), cab)
+	if err != nil {
+		return nil, err
+	}
+	return &apiCurrent{Cabinet: cab.Name, CardNum: cardNum, CardName: cardName}, nil
+}
+
+func (a *APIServer) switchCard(r *http.Request) (interface{}, error) {
+	cab, err := a.cabinet(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var req apiSwitchRequest
+	if err := json.NewDecoder(http.MaxBytesReader(nil, r.Body, maxAPIBodySize)).Decode(&req); err != nil {
+		return nil, &apiError{http.StatusBadRequest, errors.Wrap(err, "invalid request body")}
+	}
+
+	cardNum := req.Card
+	switch {
+	case req.Name != "" && req.Card != "":
+		return nil, &apiError{http.StatusBadRequest, errors.New("give either name or card, not both")}
+	case req.Name != "":
+		var ok bool
+		if cardNum, ok = cab.Cards.Lookup(req.Name); !ok {
+			return nil, &apiError{http.StatusNotFound, errors.Errorf("player %q is not registered on %s", req.Name, cab.Name)}
+		}
+	case req.Card == "":
+		return nil, &apiError{http.StatusBadRequest, errors.New("name or card is required")}
+	}
+
+	if err := a.svc.Validate(cab, cardNum); err != nil {
+		return nil, &apiError{http.StatusBadRequest, err}
+	}
+
+	user := &discordgo.User{Username: "api"}
+	if req.By != "" {
+		user.Username = "api: " + req.By
+	}
+
+	cardName, err := a.svc.Switch(r.Context(), cab, user, cardNum)
+	if err != nil {
+		return nil, err
+	}
+	return &apiCurrent{Cabinet: cab.Name, CardNum: cardNum, CardName: cardName}, nil
+}
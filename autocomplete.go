@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// maxAutocompleteChoices is the maximum number of choices Discord accepts in
+// an autocomplete response.
+const maxAutocompleteChoices = 25
+
+// recentSwitchWindow is how long a switched card keeps its ranking boost in
+// autocomplete.
+const recentSwitchWindow = 12 * time.Hour
+
+// RecentSwitches remembers when each card was last switched to, so
+// autocomplete can rank regulars of the current session first.
+type RecentSwitches struct {
+	mu   sync.Mutex
+	last map[string]time.Time
+}
+
+var recentSwitches = &RecentSwitches{last: make(map[string]time.Time)}
+
+func (r *RecentSwitches) Touch(cardNum string, at time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if at.After(r.last[cardNum]) {
+		r.last[cardNum] = at
+	}
+}
+
+func (r *RecentSwitches) Snapshot() map[string]time.Time {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	m := make(map[string]time.Time, len(r.last))
+	for cardNum, at := range r.last {
+		m[cardNum] = at
+	}
+	return m
+}
+
+type rankedCard struct {
+	name    string
+	cardNum string
+	score   int
+}
+
+// matchScore rates how well query matches a card. Zero means no match.
+func matchScore(query, name, cardNum string) int {
+	if query == "" {
+		return 1
+	}
+
+	q := strings.ToLower(query)
+	n := strings.ToLower(name)
+
+	switch {
+	case n == q:
+		return 100
+	case strings.HasPrefix(n, q):
+		return 80
+	case strings.HasSuffix(cardNum, q):
+		return 70
+	case strings.Contains(n, q):
+		return 50
+	case strings.Contains(cardNum, q):
+		return 30
+	case isSubsequence(q, n):
+		return 20
+	}
+
+	return 0
+}
+
+// isSubsequence reports whether all runes of q appear in s in order.
+func isSubsequence(q, s string) bool {
+	qr := []rune(q)
+	i := 0
+	for _, r := range s {
+		if i < len(qr) && qr[i] == r {
+			i++
+		}
+	}
+	return i == len(qr)
+}
+
+// recencyBoost favours cards that were switched to recently, decaying
+// linearly to zero over recentSwitchWindow.
+func recencyBoost(lastSwitched time.Time, now time.Time) int {
+	if lastSwitched.IsZero() {
+		return 0
+	}
+
+	age := now.Sub(lastSwitched)
+	if age >= recentSwitchWindow {
+		return 0
+	}
+
+	return int(15 * (recentSwitchWindow - age) / recentSwitchWindow)
+}
+
+// rankCards filters cards by query and sorts them by match quality and
+// recency, falling back to name order so the result is deterministic.
+func rankCards(cards map[string]string, recent map[string]time.Time, query string, now time.Time) []rankedCard {
+	query = strings.TrimSpace(query)
+
+	ranked := make([]rankedCard, 0, len(cards))
+	for name, cardNum := range cards {
+		score := matchScore(query, name, cardNum)
+		if score == 0 {
+			continue
+		}
+
+		ranked = append(ranked, rankedCard{
+			name:    name,
+			cardNum: cardNum,
+			score:   score + recencyBoost(recent[cardNum], now),
+		})
+	}
+
+	sort.Slice(ranked, func(a, b int) bool {
+		if ranked[a].score != ranked[b].score {
+			return ranked[a].score > ranked[b].score
+		}
+		return ranked[a].name < ranked[b].name
+	})
+
+	if len(ranked) > maxAutocompleteChoices {
+		ranked = ranked[:maxAutocompleteChoices]
+	}
+
+	return ranked
+}
+
+// focusedOption returns the option the user is currently typing in, looking
+// into subcommands as well.
+func focusedOption(options []*discordgo.ApplicationCommandInteractionDataOption) *discordgo.ApplicationCommandInteractionDataOption {
+	for _, opt := range options {
+		if opt.Focused {
+			return opt
+		}
+		if found := focusedOption(opt.Options); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+func switchAutocompleteChoices(i *discordgo.InteractionCreate, registry *CardRegistry) []*discordgo.ApplicationCommandOptionChoice {
+	query := ""
+	if opt := focusedOption(i.ApplicationCommandData().Options); opt != nil {
+		query = opt.StringValue()
+	}
+
+	ranked := rankCards(registry.Snapshot(), recentSwitches.Snapshot(), query, time.Now())
+
+	choices := make([]*discordgo.ApplicationCommandOptionChoice, 0, len(ranked)+1)
+	if len(links.CardsOf(interactionUser(i).ID)) > 0 && strings.HasPrefix("me", strings.ToLower(strings.TrimSpace(query))) {
+		choices = append(choices, &discordgo.ApplicationCommandOptionChoice{
+			Name:  "me (your linked card)",
+			Value: "me",
+		})
+	}
+	for _, card := range ranked {
+		choices = append(choices, &discordgo.ApplicationCommandOptionChoice{
+			Name:  fmt.Sprintf("%s (%s)", card.name, redactedCardNum(card.cardNum)),
+			Value: card.cardNum,
+		})
+	}
+
+	if len(choices) > maxAutocompleteChoices {
+		choices = choices[:maxAutocompleteChoices]
+	}
+	return choices
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+)
+
+// CabinetConfig describes one game PC. It is read from the "cabinets" list
+// of the config file:
+//
+//	cabinets:
+//	  - name: maimai
+//	    aimetxt-path: 'C:\maimai\DEVICE\aime.txt'
+//	    recordtxt-path: 'C:\maimai\record.txt'
+//	    channels: ["123456789012345678"]
+//	  - name: chunithm
+//	    game: chunithm
+//	    game-type: chunithm
+//	    aimetxt-path: 'D:\chunithm\DEVICE\aime.txt'
+//	    recordtxt-path: 'D:\chunithm\record.txt'
+//	  - name: ongeki
+//	    game: ongeki
+//	    game-type: ongeki
+//	    agent: ongeki-pc
+//	    recordtxt-path: 'D:\ongeki\record.txt'
+//
+// A cabinet with an agent has its aime.txt on the machine running that
+// agent instead of a local aimetxt-path. Game, game-type, place and
+// mysql-dburl default to the global --name, --game-type, --place and
+// --mysql-dburl options. The game-type selects the ARTEMiS tables exported
+// for the cabinet.
+type CabinetConfig struct {
+	Name          string   `json:"name"`
+	Game          string   `json:"game"`
+	GameType      string   `json:"game-type"`
+	Place         string   `json:"place"`
+	AimeTxtPath   string   `json:"aimetxt-path"`
+	Agent         string   `json:"agent"`
+	RecordTxtPath string   `json:"recordtxt-path"`
+	MySqlDBURL    string   `json:"mysql-dburl"`
+	Channels      []string `json:"channels"`
+}
+
+// cabinetsMetadataKey is the cli.App metadata key the config file's
+// cabinets are stored under by LoadConfig.
+const cabinetsMetadataKey = "cabinets"
+
+// decodeCabinetConfigs converts the generic "cabinets" value of a YAML or
+// TOML config file.
+func decodeCabinetConfigs(v interface{}) ([]*CabinetConfig, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, errors.Wrap(err, "config file: invalid cabinets")
+	}
+
+	var cfgs []*CabinetConfig
+	if err := json.Unmarshal(b, &cfgs); err != nil {
+		return nil, errors.Wrap(err, "config file: invalid cabinets")
+	}
+	return cfgs, nil
+}
+
+// cabinetConfigs returns the configured cabinets, falling back to a single
+// cabinet built from the global options.
+func cabinetConfigs(c *cli.Context) []*CabinetConfig {
+	cfgs, _ := c.App.Metadata[cabinetsMetadataKey].([]*CabinetConfig)
+	if len(cfgs) == 0 {
+		cfgs = []*CabinetConfig{{
+			Name:          c.String("name"),
+			AimeTxtPath:   c.Path("aimetxt-path"),
+			Agent:         c.String("agent-name"),
+			RecordTxtPath: c.Path("recordtxt-path"),
+		}}
+	}
+
+	for _, cfg := range cfgs {
+		if cfg.Game == "" {
+			cfg.Game = c.String("name")
+		}
+		if cfg.GameType == "" {
+			cfg.GameType = c.String("game-type")
+		}
+		if cfg.Place == "" {
+			cfg.Place = c.String("place")
+		}
+		if cfg.MySqlDBURL == "" {
+			cfg.MySqlDBURL = c.String("mysql-dburl")
+		}
+	}
+	return cfgs
+}
+
+func validateCabinetConfigs(cfgs []*CabinetConfig) []string {
+	var problems []string
+	seen := make(map[string]bool)
+	// exporters maps the export prefix of every cabinet with a DB to the
+	// cabinet, as two updaters writing the same keys overwrite each other.
+	exporters := make(map[string]string)
+	for idx, cfg := range cfgs {
+		if cfg.Name == "" {
+			problems = append(problems, fmt.Sprintf("cabinets[%d]: name is required", idx))
+			continue
+		}
+		if seen[cfg.Name] {
+			problems = append(problems, fmt.Sprintf("cabinets: duplicate name %q", cfg.Name))
+		}
+		seen[cfg.Name] = true
+
+		if cfg.AimeTxtPath == "" && cfg.Agent == "" {
+			problems = append(problems, fmt.Sprintf("cabinet %s: aimetxt-path or agent is required", cfg.Name))
+		}
+		if cfg.RecordTxtPath == "" {
+			problems = append(problems, fmt.Sprintf("cabinet %s: recordtxt-path is required", cfg.Name))
+		}
+		if _, err := gameSource(cfg.GameType); err != nil {
+			problems = append(problems, fmt.Sprintf("cabinet %s: %v", cfg.Name, err))
+		}
+
+		if cfg.MySqlDBURL != "" {
+			export := fmt.Sprintf("%s %s/%s", cfg.GameType, cfg.Place, cfg.Game)
+			if other, ok := exporters[export]; ok {
+				problems = append(problems, fmt.Sprintf("cabinet %s: exports the same %s ratings of %s/%s as cabinet %s, set a different game or place", cfg.Name, cfg.GameType, cfg.Place, cfg.Game, other))
+			} else {
+				exporters[export] = cfg.Name
+			}
+		}
+	}
+	return problems
+}
+
+// Cabinet is one game PC with its own aime.txt and card registry.
+type Cabinet struct {
+	*CabinetConfig
+
+	Aime     AimeTxt
+	Cards    *CardRegistry
+	Sessions *SessionManager
+	// Updater is the cabinet's DB updater, nil without a MySQL DB.
+	Updater *DBUpdater
+
+	// switchMu serialises switches of the cabinet's aime.txt.
+	switchMu sync.Mutex
+}
+
+// AgentStatus returns the status of the cabinet's agent, or nil if its
+// aime.txt is local.
+func (cab *Cabinet) AgentStatus() *AgentStatus {
+	remote, ok := cab.Aime.(*RemoteAimeTxt)
+	if !ok {
+		return nil
+	}
+	return remote.Status()
+}
+
+// CabinetSet holds every cabinet the bot controls.
+type CabinetSet struct {
+	list      []*Cabinet
+	byName    map[string]*Cabinet
+	byChannel map[string]*Cabinet
+}
+
+var cabinets *CabinetSet
+
+// LoadCabinets parses each cabinet's record.txt and watches it for changes
+// until ctx is done. Cabinets with an agent reach their aime.txt through
+// hub.
+func LoadCabinets(ctx context.Context, c *cli.Context, cfgs []*CabinetConfig, hub *AgentHub) (*CabinetSet, error) {
+	set := &CabinetSet{
+		byName:    make(map[string]*Cabinet),
+		byChannel: make(map[string]*Cabinet),
+	}
+
+	for _, cfg := range cfgs {
+		records, hidden, err := parseRecordTxt(cfg.RecordTxtPath)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cabinet %s", cfg.Name)
+		}
+
+		cab := &Cabinet{
+			CabinetConfig: cfg,
+			Aime:          NewLocalAimeTxt(cfg.AimeTxtPath),
+			Cards:         NewCardRegistry(records, hidden),
+		}
+		if cfg.Agent != "" {
+			if hub == nil {
+				return nil, errors.Errorf("cabinet %s: agent %q needs --agent-listen", cfg.Name, cfg.Agent)
+			}
+			cab.Aime = NewRemoteAimeTxt(hub, cfg.Agent)
+		}
+		cab.Cards.WatchRecordTxt(ctx, cfg.RecordTxtPath, c.Duration("recordtxt-reload-interval"))
+
+		set.list = append(set.list, cab)
+		set.byName[cfg.Name] = cab
+		for _, channelID := range cfg.Channels {
+			set.byChannel[channelID] = cab
+		}
+	}
+
+	return set, nil
+}
+
+func (s *CabinetSet) All() []*Cabinet {
+	return s.list
+}
+
+func (s *CabinetSet) Get(name string) (*Cabinet, bool) {
+	cab, ok := s.byName[name]
+	return cab, ok
+}
+
+// Default returns the default cabinet of channelID, or the first cabinet.
+func (s *CabinetSet) Default(channelID string) *Cabinet {
+	if cab, ok := s.byChannel[channelID]; ok {
+		return cab
+	}
+	return s.list[0]
+}
+
+// NameOf returns the player name of cardNum in any cabinet's registry.
+func (s *CabinetSet) NameOf(cardNum string) string {
+	for _, cab := range s.list {
+		if name, ok := cab.Cards.NameByCard(cardNum); ok {
+			return name
+		}
+	}
+	return "(unknown)"
+}
+
+// Lookup returns the card number registered under name in any cabinet.
+func (s *CabinetSet) Lookup(name string) (string, bool) {
+	for _, cab := range s.list {
+		if cardNum, ok := cab.Cards.Lookup(name); ok {
+			return cardNum, true
+		}
+	}
+	return "", false
+}
+
+// Snapshot returns the players of every cabinet, resolved like Lookup.
+func (s *CabinetSet) Snapshot() map[string]string {
+	all := make(map[string]string)
+	for idx := len(s.list) - 1; idx >= 0; idx-- {
+		for name, cardNum := range s.list[idx].Cards.Snapshot() {
+			all[name] = cardNum
+		}
+	}
+	return all
+}
+
+// Multiple reports whether more than one cabinet is configured, in which
+// case messages mention the cabinet.
+func (s *CabinetSet) Multiple() bool {
+	return len(s.list) > 1
+}
+
+// findOption returns the option called name, looking into subcommands as
+// well.
+func findOption(options []*discordgo.ApplicationCommandInteractionDataOption, name string) *discordgo.ApplicationCommandInteractionDataOption {
+	for _, opt := range options {
+		if opt.Name == name && opt.Type != discordgo.ApplicationCommandOptionSubCommand {
+			return opt
+		}
+		if found := findOption(opt.Options, name); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// cabinetOption is the "cabinet" option added to commands that act on a
+// cabinet.
+func cabinetOption() *discordgo.ApplicationCommandOption {
+	return &discordgo.ApplicationCommandOption{
+		Name:         "cabinet",
+		Type:         discordgo.ApplicationCommandOptionString,
+		Description:  "Cabinet (defaults to this channel's cabinet)",
+		Autocomplete: true,
+	}
+}
+
+// cabinetFor returns the cabinet named by the interaction's "cabinet"
+// option, or the channel's default cabinet.
+func cabinetFor(i *discordgo.InteractionCreate) (*Cabinet, error) {
+	if opt := findOption(i.ApplicationCommandData().Options, "cabinet"); opt != nil && opt.StringValue() != "" {
+		cab, ok := cabinets.Get(opt.StringValue())
+		if !ok {
+			return nil, errors.Errorf("unknown cabinet %q", opt.StringValue())
+		}
+		return cab, nil
+	}
+	return cabinets.Default(i.ChannelID), nil
+}
+
+func cabinetAutocompleteChoices(query string) []*discordgo.ApplicationCommandOptionChoice {
+	query = strings.ToLower(strings.TrimSpace(query))
+
+	var names []string
+	for _, cab := range cabinets.All() {
+		if strings.Contains(strings.ToLower(cab.Name), query) {
+			names = append(names, cab.Name)
+		}
+	}
+	sort.Strings(names)
+
+	choices := make([]*discordgo.ApplicationCommandOptionChoice, 0, len(names))
+	for _, name := range names {
+		choices = append(choices, &discordgo.ApplicationCommandOptionChoice{
+			Name:  name,
+			Value: name,
+		})
+	}
+	if len(choices) > maxAutocompleteChoices {
+		choices = choices[:maxAutocompleteChoices]
+	}
+	return choices
+}
+
+// autocompleteCabinet answers the autocomplete request if the user is typing
+// in the "cabinet" option. It reports whether it did.
+func autocompleteCabinet(s *discordgo.Session, i *discordgo.InteractionCreate) (bool, error) {
+	opt := focusedOption(i.ApplicationCommandData().Options)
+	if opt == nil || opt.Name != "cabinet" {
+		return false, nil
+	}
+	return true, respondAutocomplete(s, i, cabinetAutocompleteChoices(opt.StringValue()))
+}
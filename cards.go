@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// CardRegistry holds the player name to card number mapping loaded from
+// record.txt. It is safe for concurrent use; the whole map is swapped on
+// reload so readers never observe a partially parsed file.
+type CardRegistry struct {
+	mu    sync.RWMutex
+	cards map[string]string
+	// hidden holds the card numbers whose players opted out of the ratings
+	// export. It is keyed by card so it survives a rename.
+	hidden map[string]bool
+}
+
+func NewCardRegistry(cards map[string]string, hidden map[string]bool) *CardRegistry {
+	return &CardRegistry{cards: cards, hidden: hidden}
+}
+
+// Snapshot returns a copy of the current mapping.
+func (r *CardRegistry) Snapshot() map[string]string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	m := make(map[string]string, len(r.cards))
+	for name, cardNum := range r.cards {
+		m[name] = cardNum
+	}
+	return m
+}
+
+// Replace atomically swaps the mapping and the hidden cards, and returns the
+// previous mapping.
+func (r *CardRegistry) Replace(cards map[string]string, hidden map[string]bool) map[string]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	old := r.cards
+	r.cards = cards
+	r.hidden = hidden
+	return old
+}
+
+// HiddenCards returns the registered card numbers marked hidden.
+func (r *CardRegistry) HiddenCards() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var cardNums []string
+	for _, cardNum := range r.cards {
+		if r.hidden[cardNum] {
+			cardNums = append(cardNums, cardNum)
+		}
+	}
+	sort.Strings(cardNums)
+	return cardNums
+}
+
+// Lookup returns the card number registered under name.
+func (r *CardRegistry) Lookup(name string) (string, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	cardNum, ok := r.cards[name]
+	return cardNum, ok
+}
+
+// NameOf returns the player name of cardNum, or "(unknown)" if the card is
+// not registered.
+func (r *CardRegistry) NameOf(cardNum string) string {
+	if name, ok := r.NameByCard(cardNum); ok {
+		return name
+	}
+	return "(unknown)"
+}
+
+// NameByCard returns the player name cardNum is registered to.
+func (r *CardRegistry) NameByCard(cardNum string) (string, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for name, num := range r.cards {
+		if num == cardNum {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// HasCard reports whether cardNum is registered to any player.
+func (r *CardRegistry) HasCard(cardNum string) bool {
+	_, ok := r.NameByCard(cardNum)
+	return ok
+}
+
+// Len returns the number of registered cards.
+func (r *CardRegistry) Len() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return len(r.cards)
+}
+
+// Update applies fn to a copy of the mapping, writes the result to the
+// record.txt at path and swaps it in. Nothing is changed if fn or the write
+// fails.
+func (r *CardRegistry) Update(path string, fn func(cards map[string]string) error) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	next := make(map[string]string, len(r.cards))
+	for name, cardNum := range r.cards {
+		next[name] = cardNum
+	}
+
+	if err := fn(next); err != nil {
+		return err
+	}
+
+	if err := writeRecordTxt(path, next, r.hidden); err != nil {
+		return errors.Wrap(err, "failed to write record.txt")
+	}
+
+	r.cards = next
+	return nil
+}
+
+// writeRecordTxt writes cards to path in the format parseRecordTxt reads,
+// sorted by player name, keeping the hidden flag of the cards in hidden. The
+// file is replaced atomically, so a crash never leaves a truncated
+// record.txt behind.
+func writeRecordTxt(path string, cards map[string]string, hidden map[string]bool) error {
+	names := make([]string, 0, len(cards))
+	for name := range cards {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	for _, name := range names {
+		line := cards[name] + " " + name
+		if hidden[cards[name]] {
+			line += " " + recordTxtHidden
+		}
+		fmt.Fprintln(&buf, line)
+	}
+
+	return writeFileAtomic(path, buf.Bytes())
+}
+
+// writeFileAtomic replaces path with b by writing a temporary file in the
+// same directory and renaming it over path. The file keeps the mode of the
+// file it replaces, or gets 0644.
+func writeFileAtomic(path string, b []byte) error {
+	// CreateTemp makes the file 0600.
+	mode := os.FileMode(0o644)
+	if fi, err := os.Stat(path); err == nil {
+		mode = fi.Mode().Perm()
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if err := f.Chmod(mode); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+// diffCards returns the names that are present in next but not in prev
+// (added) and the other way round (removed). Names whose card number
+// changed are reported in both lists.
+func diffCards(prev, next map[string]string) (added, removed []string) {
+	for name, cardNum := range next {
+		if prevNum, ok := prev[name]; !ok || prevNum != cardNum {
+			added = append(added, name)
+		}
+	}
+	for name, cardNum := range prev {
+		if nextNum, ok := next[name]; !ok || nextNum != cardNum {
+			removed = append(removed, name)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	return added, removed
+}
+
+// WatchRecordTxt polls path for modifications until ctx is done and reloads
+// the registry when the file changes. A file that fails to parse is logged
+// and the previous mapping is kept.
+func (r *CardRegistry) WatchRecordTxt(ctx context.Context, path string, interval time.Duration) {
+	var lastModTime time.Time
+	var lastSize int64
+	if fi, err := os.Stat(path); err == nil {
+		lastModTime = fi.ModTime()
+		lastSize = fi.Size()
+	}
+
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(interval):
+			}
+
+			fi, err := os.Stat(path)
+			if err != nil {
+				log.Println("record.txt watcher: failed to stat file:", err)
+				continue
+			}
+			if fi.ModTime().Equal(lastModTime) && fi.Size() == lastSize {
+				continue
+			}
+			lastModTime = fi.ModTime()
+			lastSize = fi.Size()
+
+			r.Reload(path)
+		}
+	}()
+}
+
+// Reload re-parses path and swaps the registry contents on success.
+func (r *CardRegistry) Reload(path string) {
+	records, hidden, err := parseRecordTxt(path)
+	if err != nil {
+		log.Println("record.txt reload: keeping previous cards, failed to parse:", err)
+		return
+	}
+
+	prev := r.Replace(records, hidden)
+	added, removed := diffCards(prev, records)
+	if len(added) == 0 && len(removed) == 0 {
+		log.Println("record.txt reload: no changes")
+		return
+	}
+
+	log.Printf("record.txt reload: %d cards loaded, added: [%s], removed: [%s]",
+		len(records), strings.Join(added, ", "), strings.Join(removed, ", "))
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/pkg/errors"
+	"github.com/samber/lo"
+)
+
+var cardCommand = &discordgo.ApplicationCommand{
+	Name:        "card",
+	Description: "Manage registered AIME cards",
+	Options: []*discordgo.ApplicationCommandOption{
+		{
+			Name:        "add",
+			Description: "Register a new AIME card",
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Name:        "name",
+					Type:        discordgo.ApplicationCommandOptionString,
+					Description: "Player name",
+					Required:    true,
+				},
+				{
+					Name:        "number",
+					Type:        discordgo.ApplicationCommandOptionString,
+					Description: "AIME access code (20 digits)",
+					Required:    true,
+				},
+				cabinetOption(),
+			},
+		},
+		{
+			Name:        "remove",
+			Description: "Unregister an AIME card",
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Name:         "name",
+					Type:         discordgo.ApplicationCommandOptionString,
+					Description:  "Player name",
+					Required:     true,
+					Autocomplete: true,
+				},
+				cabinetOption(),
+			},
+		},
+		{
+			Name:        "rename",
+			Description: "Rename a registered AIME card",
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Name:         "name",
+					Type:         discordgo.ApplicationCommandOptionString,
+					Description:  "Current player name",
+					Required:     true,
+					Autocomplete: true,
+				},
+				{
+					Name:        "new-name",
+					Type:        discordgo.ApplicationCommandOptionString,
+					Description: "New player name",
+					Required:    true,
+				},
+				cabinetOption(),
+			},
+		},
+		{
+			Name:        "list",
+			Description: "List registered AIME cards",
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Options: []*discordgo.ApplicationCommandOption{
+				cabinetOption(),
+			},
+		},
+	},
+}
+
+var playerNameRegexp = regexp.MustCompile(`^\S{1,32}$`)
+
+// isAdmin reports whether the invoking member holds the configured admin
+// role. Card management is disabled when no admin role is configured.
+func (h *CommandHandlerCtx) isAdmin(i *discordgo.InteractionCreate) bool {
+	adminRole := h.c.String("admin-role")
+	if adminRole == "" || i.Member == nil {
+		return false
+	}
+
+	return lo.Contains(i.Member.Roles, adminRole)
+}
+
+func subCommandOptions(opt *discordgo.ApplicationCommandInteractionDataOption) map[string]*discordgo.ApplicationCommandInteractionDataOption {
+	return lo.SliceToMap(opt.Options, func(o *discordgo.ApplicationCommandInteractionDataOption) (string, *discordgo.ApplicationCommandInteractionDataOption) {
+		return o.Name, o
+	})
+}
+
+func (h *CommandHandlerCtx) CommandCard(s *discordgo.Session, i *discordgo.InteractionCreate) error {
+	if !h.isAdmin(i) {
+		log.Println("card: denied non-admin", interactionUser(i).Username)
+		return respondEphemeral(s, i, "You are not allowed to manage cards.")
+	}
+
+	cab, err := cabinetFor(i)
+	if err != nil {
+		return respondEphemeral(s, i, fmt.Sprintf("Cannot manage cards: %v", err))
+	}
+
+	sub := i.ApplicationCommandData().Options[0]
+	opts := subCommandOptions(sub)
+
+	var message string
+	switch sub.Name {
+	case "add":
+		name, cardNum := opts["name"].StringValue(), opts["number"].StringValue()
+		err = cab.Cards.Update(cab.RecordTxtPath, func(m map[string]string) error {
+			if !playerNameRegexp.MatchString(name) {
+				return errors.New("player name must be 1-32 characters without spaces")
+			}
+			if err := ValidateAccessCode(cardNum, nil); err != nil {
+				return err
+			}
+			if _, ok := m[name]; ok {
+				return fmt.Errorf("player **%s** is already registered", name)
+			}
+			for n, num := range m {
+				if num == cardNum {
+					return fmt.Errorf("card `%s` is already registered to **%s**", redactedCardNum(cardNum), n)
+				}
+			}
+			m[name] = cardNum
+			return nil
+		})
+		message = fmt.Sprintf("Registered **%s** (`%s`)", name, redactedCardNum(cardNum))
+	case "remove":
+		name := opts["name"].StringValue()
+		err = cab.Cards.Update(cab.RecordTxtPath, func(m map[string]string) error {
+			if _, ok := m[name]; !ok {
+				return fmt.Errorf("player **%s** is not registered", name)
+			}
+			delete(m, name)
+			return nil
+		})
+		message = fmt.Sprintf("Removed **%s**", name)
+	case "rename":
+		name, newName := opts["name"].StringValue(), opts["new-name"].StringValue()
+		err = cab.Cards.Update(cab.RecordTxtPath, func(m map[string]string) error {
+			if !playerNameRegexp.MatchString(newName) {
+				return errors.New("player name must be 1-32 characters without spaces")
+			}
+			cardNum, ok := m[name]
+			if !ok {
+				return fmt.Errorf("player **%s** is not registered", name)
+			}
+			if _, ok := m[newName]; ok {
+				return fmt.Errorf("player **%s** is already registered", newName)
+			}
+			delete(m, name)
+			m[newName] = cardNum
+			return nil
+		})
+		message = fmt.Sprintf("Renamed **%s** to **%s**", name, newName)
+	case "list":
+		registered := h.svc.Cards(cab)
+
+		lines := lo.Map(registered, func(card RegisteredCard, _ int) string {
+			return fmt.Sprintf("- **%s** (`%s`)", card.Name, redactedCardNum(card.CardNum))
+		})
+		message = joinLines(fmt.Sprintf("%d registered cards:\n", len(registered)), lines)
+	default:
+		message = "Unknown subcommand"
+	}
+
+	if err != nil {
+		return errors.Wrapf(err, "failed to %s card", sub.Name)
+	}
+
+	if sub.Name != "list" {
+		log.Println("card:", cab.Name, interactionUser(i).Username, message)
+	}
+
+	return respondEphemeral(s, i, message)
+}
+
+func (h *CommandHandlerCtx) AutocompleteCard(s *discordgo.Session, i *discordgo.InteractionCreate) error {
+	if ok, err := autocompleteCabinet(s, i); ok {
+		return err
+	}
+
+	cab, err := cabinetFor(i)
+	if err != nil {
+		return err
+	}
+
+	return respondAutocomplete(s, i, playerChoices(i, cab.Cards.Snapshot()))
+}
+
+// playerChoices offers the player names of cards that match the focused
+// option.
+func playerChoices(i *discordgo.InteractionCreate, cards map[string]string) []*discordgo.ApplicationCommandOptionChoice {
+	query := ""
+	if opt := focusedOption(i.ApplicationCommandData().Options); opt != nil {
+		query = opt.StringValue()
+	}
+
+	ranked := rankCards(cards, nil, query, time.Now())
+	return lo.Map(ranked, func(card rankedCard, _ int) *discordgo.ApplicationCommandOptionChoice {
+		return &discordgo.ApplicationCommandOptionChoice{
+			Name:  card.name,
+			Value: card.name,
+		}
+	})
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/GalvinGao/discord-aime-switcher/rating"
+	"github.com/bwmarrin/discordgo"
+)
+
+// chartTable holds the chart constants /rating rates with, nil if none was
+// configured.
+var chartTable *rating.ChartTable
+
+const (
+	ratingQueryTimeout = 5 * time.Second
+	// ratingTitleWidth is where titles are cut so both lists fit one embed.
+	ratingTitleWidth = 18
+)
+
+var ratingCommand = &discordgo.ApplicationCommand{
+	Name:        "rating",
+	Description: "Show the B35/B15 breakdown of your maimai DX rating",
+	Options: []*discordgo.ApplicationCommandOption{
+		cabinetOption(),
+	},
+}
+
+func (h *CommandHandlerCtx) CommandRating(s *discordgo.Session, i *discordgo.InteractionCreate) error {
+	cab, err := cabinetFor(i)
+	if err != nil {
+		return respondEphemeral(s, i, err.Error())
+	}
+	if cab.GameType != defaultGameType {
+		return respondEphemeral(s, i, fmt.Sprintf("**%s** runs %s, /rating only knows maimai DX", cab.Name, cab.GameType))
+	}
+	if cab.Updater == nil {
+		return respondEphemeral(s, i, fmt.Sprintf("**%s** has no game database configured", cab.Name))
+	}
+	if chartTable == nil {
+		return respondEphemeral(s, i, "No chart constant table is configured")
+	}
+
+	cardNum, err := resolveCardArg(interactionUser(i).ID, "")
+	if err != nil {
+		return respondEphemeral(s, i, err.Error())
+	}
+
+	if err := deferResponse(s, i, true); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), ratingQueryTimeout)
+	defer cancel()
+
+	record, err := cab.Updater.LatestRatingRecord(ctx, cardNum)
+	if err != nil {
+		return err
+	}
+	if record == nil {
+		return respondEphemeral(s, i, fmt.Sprintf("Your card `%s` has no rating on **%s** yet", redactedCardNum(cardNum), cab.Name))
+	}
+
+	oldList, err := rating.ParseList(record.RatingList)
+	if err != nil {
+		return err
+	}
+	newList, err := rating.ParseList(record.NewRatingList)
+	if err != nil {
+		return err
+	}
+	b := rating.Compute(chartTable, oldList, newList)
+
+	log.Println("rating: responding with", b.Total, "for user", record.User, "on", cab.Name)
+
+	return respondMessage(s, i, &discordgo.InteractionResponseData{
+		Embeds: []*discordgo.MessageEmbed{ratingEmbed(b, record.Rating)},
+		Flags:  discordgo.MessageFlagsEphemeral,
+	})
+}
+
+func (h *CommandHandlerCtx) AutocompleteRating(s *discordgo.Session, i *discordgo.InteractionCreate) error {
+	// The cabinet is the only option with autocompletion.
+	_, err := autocompleteCabinet(s, i)
+	return err
+}
+
+func ratingEmbed(b *rating.Breakdown, stored int) *discordgo.MessageEmbed {
+	var desc strings.Builder
+	fmt.Fprintf(&desc, "**B35** %d\n%s\n**B15** %d\n%s", b.OldTotal, ratingTable(b.Old), b.NewTotal, ratingTable(b.New))
+
+	footer := fmt.Sprintf("Game rating %d", stored)
+	if b.Unknown > 0 {
+		footer += fmt.Sprintf(" · %d charts missing from the constant table", b.Unknown)
+	}
+
+	return &discordgo.MessageEmbed{
+		Title:       fmt.Sprintf("Rating %d", b.Total),
+		Description: desc.String(),
+		Footer:      &discordgo.MessageEmbedFooter{Text: footer},
+	}
+}
+
+// ratingTable lays out a best list as a code block, one chart per line.
+func ratingTable(list []*rating.Scored) string {
+	if len(list) == 0 {
+		return "*none*\n"
+	}
+
+	var sb strings.Builder
+	sb.WriteString("```\n")
+	for idx, s := range list {
+		constant, ra := "  ?", "  ?"
+		if s.Known() {
+			constant = fmt.Sprintf("%d.%d", s.Constant/10, s.Constant%10)
+			ra = fmt.Sprintf("%3d", s.Rating)
+		}
+
+		title := s.Title
+		if title == "" {
+			title = fmt.Sprintf("#%d", s.MusicID)
+		}
+		if r := []rune(title); len(r) > ratingTitleWidth {
+			title = string(r[:ratingTitleWidth-1]) + "…"
+		}
+
+		fmt.Fprintf(&sb, "%2d %s %-4s %s %8.4f%% %s\n", idx+1, ra, constant, s.Difficulty.Short(), float64(s.Achievement)/rating.AchievementScale, title)
+	}
+	sb.WriteString("```\n")
+	return sb.String()
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// envVarPrefix prefixes the environment variable of every option, e.g.
+// --aimetxt-path can be set with AIMESWITCHER_AIMETXT_PATH. Appending _FILE
+// (AIMESWITCHER_TOKEN_FILE) reads the value from a file instead, which is
+// meant for secrets mounted by a service manager.
+const envVarPrefix = "AIMESWITCHER_"
+
+// secretOptions are never printed in the startup report.
+var secretOptions = map[string]bool{
+	"token":                true,
+	"mysql-dburl":          true,
+	"r2-accountkey":        true,
+	"agent-token":          true,
+	"api-token":            true,
+	"export-pseudonym-key": true,
+	"s3-secretaccesskey":   true,
+	"webhook-token":        true,
+}
+
+// requiredOptions must be set by a flag, the environment or the config file.
+var requiredOptions = []string{"token", "appid"}
+
+func envVarName(name string) string {
+	return envVarPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// withEnvVars attaches the AIMESWITCHER_* environment variable to every flag
+// so it also shows up in --help.
+func withEnvVars(flags []cli.Flag) []cli.Flag {
+	for _, f := range flags {
+		switch f := f.(type) {
+		case *cli.StringFlag:
+			f.EnvVars = append(f.EnvVars, envVarName(f.Name))
+		case *cli.PathFlag:
+			f.EnvVars = append(f.EnvVars, envVarName(f.Name))
+		case *cli.BoolFlag:
+			f.EnvVars = append(f.EnvVars, envVarName(f.Name))
+		case *cli.DurationFlag:
+			f.EnvVars = append(f.EnvVars, envVarName(f.Name))
+		}
+	}
+	return flags
+}
+
+// readConfigFile parses a YAML or TOML file, chosen by extension, into a
+// map of option name to value. Keys use the flag names; underscores are
+// accepted in place of dashes.
+func readConfigFile(path string) (map[string]interface{}, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read config file")
+	}
+
+	raw := make(map[string]interface{})
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(b, &raw)
+	case ".toml":
+		err = toml.Unmarshal(b, &raw)
+	default:
+		return nil, errors.Errorf("unsupported config file extension %q, use .yaml, .yml or .toml", ext)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse config file")
+	}
+
+	values := make(map[string]interface{}, len(raw))
+	for k, v := range raw {
+		values[strings.ReplaceAll(k, "_", "-")] = v
+	}
+	return values, nil
+}
+
+// configValue turns a config file value into a flag value. Lists become
+// the comma-separated lists the flags take.
+func configValue(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case []interface{}:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			switch item.(type) {
+			case []interface{}, map[string]interface{}:
+				return "", errors.New("lists may only hold plain values")
+			}
+			items = append(items, fmt.Sprint(item))
+		}
+		return strings.Join(items, ","), nil
+	case map[string]interface{}:
+		return "", errors.New("expected a plain value or a list, got a table")
+	default:
+		return fmt.Sprint(v), nil
+	}
+}
+
+// LoadConfig layers the config file and file-based secrets below the
+// command line flags and environment variables, validates the result and
+// logs a report of where each option came from. It is the app's Before
+// hook.
+func LoadConfig(c *cli.Context) error {
+	sources := make(map[string]string)
+	names := make(map[string]bool)
+	for _, f := range c.App.Flags {
+		name := f.Names()[0]
+		names[name] = true
+		if c.IsSet(name) {
+			sources[name] = "flag/env"
+		}
+	}
+
+	for name := range names {
+		if c.IsSet(name) {
+			continue
+		}
+
+		path := os.Getenv(envVarName(name) + "_FILE")
+		if path == "" {
+			continue
+		}
+
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return errors.Wrapf(err, "failed to read %s_FILE", envVarName(name))
+		}
+		if err := c.Set(name, strings.TrimSpace(string(b))); err != nil {
+			return errors.Wrapf(err, "invalid value in %s_FILE", envVarName(name))
+		}
+		sources[name] = "env file"
+	}
+
+	if path := c.Path("config"); path != "" {
+		values, err := readConfigFile(path)
+		if err != nil {
+			return err
+		}
+
+		for name, v := range values {
+			if name == cabinetsMetadataKey {
+				cfgs, err := decodeCabinetConfigs(v)
+				if err != nil {
+					return err
+				}
+				c.App.Metadata[cabinetsMetadataKey] = cfgs
+				continue
+			}
+			if !names[name] || name == "config" {
+				return errors.Errorf("config file: unknown option %q", name)
+			}
+			if c.IsSet(name) {
+				continue
+			}
+
+			value, err := configValue(v)
+			if err != nil {
+				return errors.Wrapf(err, "config file: invalid value for %q", name)
+			}
+			if err := c.Set(name, value); err != nil {
+				return errors.Wrapf(err, "config file: invalid value for %q", name)
+			}
+			sources[name] = "config file"
+		}
+	}
+
+	if err := validateConfig(c); err != nil {
+		return err
+	}
+
+	reportConfig(c, sources)
+	return nil
+}
+
+// agentMode reports whether the agent command is being run.
+func agentMode(c *cli.Context) bool {
+	return c.Args().First() == "agent"
+}
+
+func validateConfig(c *cli.Context) error {
+	var problems []string
+
+	if agentMode(c) {
+		for _, name := range []string{"server-url", "agent-token", "agent-name", "aimetxt-path"} {
+			if c.String(name) == "" {
+				problems = append(problems, fmt.Sprintf("%s is required in agent mode (--%s or %s)", name, name, envVarName(name)))
+			}
+		}
+		if len(problems) > 0 {
+			return errors.Errorf("invalid configuration:\n  - %s", strings.Join(problems, "\n  - "))
+		}
+		return nil
+	}
+
+	for _, name := range requiredOptions {
+		if c.String(name) == "" {
+			problems = append(problems, fmt.Sprintf("%s is required (--%s or %s)", name, name, envVarName(name)))
+		}
+	}
+
+	if _, ok := c.App.Metadata[cabinetsMetadataKey]; ok {
+		problems = append(problems, validateCabinetConfigs(cabinetConfigs(c))...)
+	} else {
+		problems = append(problems, missingOptions(c, "no cabinets are configured", "recordtxt-path")...)
+		if c.String("agent-name") == "" {
+			problems = append(problems, missingOptions(c, "no cabinets or agent-name are configured", "aimetxt-path")...)
+		}
+		if _, err := gameSource(c.String("game-type")); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+
+	hasDB, hasAgent := false, false
+	for _, cfg := range cabinetConfigs(c) {
+		hasDB = hasDB || cfg.MySqlDBURL != ""
+		hasAgent = hasAgent || cfg.Agent != ""
+	}
+	if c.String("api-listen") != "" {
+		problems = append(problems, missingOptions(c, "api-listen is set", "api-token")...)
+	}
+	if hasAgent {
+		problems = append(problems, missingOptions(c, "a cabinet uses an agent", "agent-listen", "agent-token")...)
+	} else if c.String("agent-listen") != "" {
+		problems = append(problems, missingOptions(c, "agent-listen is set", "agent-token")...)
+	}
+
+	for _, name := range []string{"recordtxt-reload-interval", "session-timeout", "session-idle-timeout"} {
+		if c.Duration(name) < 0 {
+			problems = append(problems, fmt.Sprintf("%s must not be negative", name))
+		}
+	}
+	if c.Duration("recordtxt-reload-interval") == 0 {
+		problems = append(problems, "recordtxt-reload-interval must be positive")
+	}
+
+	if guestCard := c.String("guest-card"); guestCard != "" {
+		if err := ValidateAccessCode(guestCard, nil); err != nil {
+			problems = append(problems, fmt.Sprintf("guest-card: %v", err))
+		}
+	}
+	if c.Duration("session-idle-timeout") > 0 && !hasDB {
+		problems = append(problems, "session-idle-timeout requires mysql-dburl")
+	}
+	if c.String("play-announce-channel") != "" && !hasDB {
+		problems = append(problems, "play-announce-channel requires mysql-dburl")
+	}
+
+	if hasDB {
+		backend := c.String("export-backend")
+		reason := "export-backend=" + backend
+		switch backend {
+		case "r2":
+			problems = append(problems, missingOptions(c, reason, "r2-accountid", "r2-bucket", "r2-accountkeyid", "r2-accountkey")...)
+		case "s3":
+			problems = append(problems, missingOptions(c, reason, "s3-bucket", "s3-region")...)
+		case "file":
+			problems = append(problems, missingOptions(c, reason, "export-dir")...)
+		case "webhook":
+			problems = append(problems, missingOptions(c, reason, "webhook-url")...)
+		default:
+			problems = append(problems, fmt.Sprintf("export-backend must be one of r2, s3, file or webhook, got %q", backend))
+		}
+		if _, err := parseExportFormats(c.String("export-formats")); err != nil {
+			problems = append(problems, err.Error())
+		}
+		if _, err := parseDatasets(c.String("export-datasets")); err != nil {
+			problems = append(problems, err.Error())
+		}
+		if c.String("export-allow-columns") != "" && c.IsSet("export-deny-columns") {
+			problems = append(problems, "export-allow-columns and export-deny-columns cannot be used together")
+		}
+		if _, err := NewExportPolicy(c.String("export-allow-columns"), c.String("export-deny-columns"), "", nil); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+
+	if len(problems) > 0 {
+		return errors.Errorf("invalid configuration:\n  - %s", strings.Join(problems, "\n  - "))
+	}
+	return nil
+}
+
+func missingOptions(c *cli.Context, reason string, names ...string) []string {
+	var problems []string
+	for _, name := range names {
+		if c.String(name) == "" {
+			problems = append(problems, fmt.Sprintf("%s is required when %s", name, reason))
+		}
+	}
+	return problems
+}
+
+func reportConfig(c *cli.Context, sources map[string]string) {
+	names := make([]string, 0, len(c.App.Flags))
+	for _, f := range c.App.Flags {
+		if name := f.Names()[0]; name != "help" && name != "config" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	log.Println("config: effective configuration")
+	for _, name := range names {
+		source, ok := sources[name]
+		if !ok {
+			source = "default"
+		}
+
+		var value string
+		switch v := c.Value(name).(type) {
+		case time.Duration:
+			value = v.String()
+		default:
+			value = fmt.Sprint(v)
+		}
+		if value == "" {
+			continue
+		}
+		if secretOptions[name] {
+			value = "<redacted>"
+		}
+
+		log.Printf("config:   %-26s = %s (%s)", name, value, source)
+	}
+}
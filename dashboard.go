@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+//go:embed web
+var webFS embed.FS
+
+const (
+	// dashboardRefreshInterval re-sends the state even without a change, so
+	// a switch made by hand on the cab or through an agent shows up.
+	dashboardRefreshInterval = 30 * time.Second
+	// dashboardStateTimeout bounds reading the active cards, which may mean
+	// asking an agent.
+	dashboardStateTimeout = 5 * time.Second
+	maxLeaderboardSize    = 20
+)
+
+// Dashboard serves the embedded web UI and pushes its state to connected
+// browsers over server-sent events whenever a card is switched, the queue
+// changes or the DB updater reads new profiles.
+type Dashboard struct {
+	svc *CardService
+
+	mu           sync.Mutex
+	subscribers  map[chan struct{}]struct{}
+	leaderboards map[string][]*PlayerProfile
+}
+
+func NewDashboard(svc *CardService) *Dashboard {
+	d := &Dashboard{
+		svc:          svc,
+		subscribers:  make(map[chan struct{}]struct{}),
+		leaderboards: make(map[string][]*PlayerProfile),
+	}
+	svc.OnSwitch(func(*Cabinet) { d.Notify() })
+	return d
+}
+
+// Notify tells every connected browser to fetch a new state.
+func (d *Dashboard) Notify() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for ch := range d.subscribers {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Observer returns a ProfileObserver that feeds cab's leaderboard.
+func (d *Dashboard) Observer(cab *Cabinet) ProfileObserver {
+	return func(profiles []*PlayerProfile) {
+		d.mu.Lock()
+		d.leaderboards[cab.Name] = leaderboard(visibleProfiles(profiles))
+		d.mu.Unlock()
+
+		d.Notify()
+	}
+}
+
+// leaderboard keeps the latest version of each user's profile, ranked by
+// rating.
+func leaderboard(profiles []*PlayerProfile) []*PlayerProfile {
+	latest := make(map[int64]*PlayerProfile)
+	for _, p := range profiles {
+		if prev, ok := latest[p.User]; !ok || p.Version > prev.Version {
+			latest[p.User] = p
+		}
+	}
+
+	board := make([]*PlayerProfile, 0, len(latest))
+	for _, p := range latest {
+		board = append(board, p)
+	}
+	sort.Slice(board, func(a, b int) bool {
+		if board[a].Rating != board[b].Rating {
+			return board[a].Rating > board[b].Rating
+		}
+		return board[a].UserName < board[b].UserName
+	})
+
+	if len(board) > maxLeaderboardSize {
+		board = board[:maxLeaderboardSize]
+	}
+	return board
+}
+
+type dashboardState struct {
+	Cabinets []*dashboardCabinet `json:"cabinets"`
+	Queue    []*dashboardQueued  `json:"queue"`
+}
+
+type dashboardCabinet struct {
+	Name        string                 `json:"name"`
+	Game        string                 `json:"game"`
+	CardNum     string                 `json:"cardNum"`
+	CardName    string                 `json:"cardName"`
+	Error       string                 `json:"error,omitempty"`
+	Agent       *AgentStatus           `json:"agent,omitempty"`
+	Players     []string               `json:"players"`
+	Leaderboard []*dashboardLeaderLine `json:"leaderboard"`
+}
+
+type dashboardLeaderLine struct {
+	UserName     string `json:"userName"`
+	Rating       string `json:"rating"`
+	PlayCount    int64  `json:"playCount"`
+	LastPlayDate string `json:"lastPlayDate"`
+}
+
+type dashboardQueued struct {
+	Username string    `json:"username"`
+	Cabinet  string    `json:"cabinet"`
+	CardName string    `json:"cardName"`
+	JoinedAt time.Time `json:"joinedAt"`
+}
+
+func (d *Dashboard) state(ctx context.Context) *dashboardState {
+	ctx, cancel := context.WithTimeout(ctx, dashboardStateTimeout)
+	defer cancel()
+
+	state := &dashboardState{
+		Cabinets: []*dashboardCabinet{},
+		Queue:    []*dashboardQueued{},
+	}
+
+	for _, cab := range cabinets.All() {
+		dc := &dashboardCabinet{Name: cab.Name, Game: cab.Game}
+
+		cardNum, cardName, err := d.svc.Current(ctx, cab)
+		if err != nil {
+			dc.Error = err.Error()
+		}
+		if dc.Agent = cab.AgentStatus(); dc.Agent != nil && dc.Error == "" {
+			dc.Error = dc.Agent.Problem()
+		}
+		dc.CardNum, dc.CardName = redactedCardNum(cardNum), cardName
+
+		for _, card := range d.svc.Cards(cab) {
+			dc.Players = append(dc.Players, card.Name)
+		}
+
+		d.mu.Lock()
+		for _, p := range d.leaderboards[cab.Name] {
+			dc.Leaderboard = append(dc.Leaderboard, &dashboardLeaderLine{
+				UserName:     p.UserName,
+				Rating:       p.FormatRating(p.Rating),
+				PlayCount:    p.PlayCount,
+				LastPlayDate: p.LastPlayDate,
+			})
+		}
+		d.mu.Unlock()
+
+		state.Cabinets = append(state.Cabinets, dc)
+	}
+
+	if queue != nil {
+		for _, e := range queue.List() {
+			cab := e.cabinet()
+			state.Queue = append(state.Queue, &dashboardQueued{
+				Username: e.Username,
+				Cabinet:  cab.Name,
+				CardName: cab.Cards.NameOf(e.CardNum),
+				JoinedAt: e.JoinedAt,
+			})
+		}
+	}
+
+	return state
+}
+
+// StaticHandler serves the embedded web UI. The page itself holds no data
+// and asks for the API token.
+func (d *Dashboard) StaticHandler() http.Handler {
+	sub, err := fs.Sub(webFS, "web")
+	if err != nil {
+		panic(err)
+	}
+	return http.FileServer(http.FS(sub))
+}
+
+// ServeEvents streams the dashboard state as server-sent events until the
+// browser disconnects.
+func (d *Dashboard) ServeEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	ch := make(chan struct{}, 1)
+	d.mu.Lock()
+	d.subscribers[ch] = struct{}{}
+	d.mu.Unlock()
+	defer func() {
+		d.mu.Lock()
+		delete(d.subscribers, ch)
+		d.mu.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	for {
+		b, err := json.Marshal(d.state(r.Context()))
+		if err != nil {
+			log.Println("dashboard: failed to marshal state:", err)
+			return
+		}
+		if _, err := fmt.Fprintf(w, "event: state\ndata: %s\n\n", b); err != nil {
+			return
+		}
+		flusher.Flush()
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ch:
+		case <-time.After(dashboardRefreshInterval):
+		}
+	}
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/samber/lo"
+)
+
+// DatasetVersion is the version of the dataset objects.
+const DatasetVersion = 1
+
+// playlogRecentLimit is the number of most recent plays exported per user.
+const playlogRecentLimit = 100
+
+// Dataset is a game table exported next to the ratings, as a delta export
+// below <name>-v1/<place>/<game>. Unlike the ratings it is not observed by
+// the bot itself.
+type Dataset struct {
+	Name string
+	// GameType is the game type whose tables the dataset reads.
+	GameType string
+	Table    string
+	// Columns are read for every row, in the order Scan reads them.
+	Columns string
+	// Marker is the aggregate over a user's rows that moves when any of
+	// them changes.
+	Marker string
+	// Scan reads one row into its typed struct.
+	Scan func(rows *sql.Rows) (datasetRow, error)
+	// Recent keeps only the last Recent rows of each user, by ID. Zero
+	// keeps every row.
+	Recent int
+}
+
+// datasetRow is a row of a dataset table. setUser replaces the user ID
+// with its exported ID.
+type datasetRow interface {
+	userID() int64
+	setUser(user int64)
+}
+
+// DatasetObject is the per-user object of a dataset export.
+type DatasetObject struct {
+	Version int          `json:"version"`
+	Dataset string       `json:"dataset"`
+	User    int64        `json:"user"`
+	Rows    []datasetRow `json:"rows"`
+}
+
+// ScoreBest is a row of mai2_score_best, the best score of a user on a
+// chart.
+type ScoreBest struct {
+	ID            int64 `json:"id"`
+	User          int64 `json:"user"`
+	MusicID       int64 `json:"musicId"`
+	Level         int64 `json:"level"`
+	PlayCount     int64 `json:"playCount"`
+	Achievement   int64 `json:"achievement"`
+	ComboStatus   int64 `json:"comboStatus"`
+	SyncStatus    int64 `json:"syncStatus"`
+	DeluxscoreMax int64 `json:"deluxscoreMax"`
+	ScoreRank     int64 `json:"scoreRank"`
+}
+
+func (s *ScoreBest) userID() int64      { return s.User }
+func (s *ScoreBest) setUser(user int64) { s.User = user }
+
+// Playlog is a row of mai2_playlog, one track played. The place columns
+// are not exported.
+type Playlog struct {
+	ID                    int64  `json:"id"`
+	User                  int64  `json:"user"`
+	PlaylogID             int64  `json:"playlogId"`
+	Version               int64  `json:"version"`
+	UserPlayDate          string `json:"userPlayDate"`
+	TrackNo               int64  `json:"trackNo"`
+	MusicID               int64  `json:"musicId"`
+	Level                 int64  `json:"level"`
+	Achievement           int64  `json:"achievement"`
+	Deluxscore            int64  `json:"deluxscore"`
+	ScoreRank             int64  `json:"scoreRank"`
+	MaxCombo              int64  `json:"maxCombo"`
+	TotalCombo            int64  `json:"totalCombo"`
+	MaxSync               int64  `json:"maxSync"`
+	TotalSync             int64  `json:"totalSync"`
+	FastCount             int64  `json:"fastCount"`
+	LateCount             int64  `json:"lateCount"`
+	IsClear               bool   `json:"isClear"`
+	IsAchieveNewRecord    bool   `json:"isAchieveNewRecord"`
+	IsDeluxscoreNewRecord bool   `json:"isDeluxscoreNewRecord"`
+	ComboStatus           int64  `json:"comboStatus"`
+	SyncStatus            int64  `json:"syncStatus"`
+	BeforeRating          int64  `json:"beforeRating"`
+	AfterRating           int64  `json:"afterRating"`
+}
+
+func (p *Playlog) userID() int64      { return p.User }
+func (p *Playlog) setUser(user int64) { p.User = user }
+
+// Item is a row of mai2_item_item.
+type Item struct {
+	ID       int64 `json:"id"`
+	User     int64 `json:"user"`
+	ItemKind int64 `json:"itemKind"`
+	ItemID   int64 `json:"itemId"`
+	Stock    int64 `json:"stock"`
+	IsValid  bool  `json:"isValid"`
+}
+
+func (i *Item) userID() int64      { return i.User }
+func (i *Item) setUser(user int64) { i.User = user }
+
+// Character is a row of mai2_item_character.
+type Character struct {
+	ID          int64 `json:"id"`
+	User        int64 `json:"user"`
+	CharacterID int64 `json:"characterId"`
+	Level       int64 `json:"level"`
+	Awakening   int64 `json:"awakening"`
+	UseCount    int64 `json:"useCount"`
+}
+
+func (c *Character) userID() int64      { return c.User }
+func (c *Character) setUser(user int64) { c.User = user }
+
+// MapProgress is a row of mai2_item_map.
+type MapProgress struct {
+	ID         int64 `json:"id"`
+	User       int64 `json:"user"`
+	MapID      int64 `json:"mapId"`
+	Distance   int64 `json:"distance"`
+	IsLock     bool  `json:"isLock"`
+	IsClear    bool  `json:"isClear"`
+	IsComplete bool  `json:"isComplete"`
+}
+
+func (m *MapProgress) userID() int64      { return m.User }
+func (m *MapProgress) setUser(user int64) { m.User = user }
+
+var datasets = map[string]*Dataset{
+	"scores": {
+		Name:     "scores",
+		GameType: "maimai",
+		Table:    "mai2_score_best",
+		Columns:  "id, user, musicId, level, playCount, achievement, comboStatus, syncStatus, deluxscoreMax, scoreRank",
+		// Improving a score updates the row in place, but always counts a
+		// play.
+		Marker: "COUNT(*), COALESCE(SUM(playCount), 0)",
+		Scan: func(rows *sql.Rows) (datasetRow, error) {
+			var s ScoreBest
+			return &s, rows.Scan(&s.ID, &s.User, &s.MusicID, &s.Level, &s.PlayCount, &s.Achievement, &s.ComboStatus, &s.SyncStatus, &s.DeluxscoreMax, &s.ScoreRank)
+		},
+	},
+	"playlogs": {
+		Name:     "playlogs",
+		GameType: "maimai",
+		Table:    "mai2_playlog",
+		Columns:  "id, user, playlogId, version, userPlayDate, trackNo, musicId, level, achievement, deluxscore, scoreRank, maxCombo, totalCombo, maxSync, totalSync, fastCount, lateCount, isClear, isAchieveNewRecord, isDeluxscoreNewRecord, comboStatus, syncStatus, beforeRating, afterRating",
+		Marker:   "COUNT(*), MAX(id)",
+		Scan: func(rows *sql.Rows) (datasetRow, error) {
+			var p Playlog
+			return &p, rows.Scan(&p.ID, &p.User, &p.PlaylogID, &p.Version, &p.UserPlayDate, &p.TrackNo, &p.MusicID, &p.Level, &p.Achievement, &p.Deluxscore, &p.ScoreRank, &p.MaxCombo, &p.TotalCombo, &p.MaxSync, &p.TotalSync, &p.FastCount, &p.LateCount, &p.IsClear, &p.IsAchieveNewRecord, &p.IsDeluxscoreNewRecord, &p.ComboStatus, &p.SyncStatus, &p.BeforeRating, &p.AfterRating)
+		},
+		Recent: playlogRecentLimit,
+	},
+	"items": {
+		Name:     "items",
+		GameType: "maimai",
+		Table:    "mai2_item_item",
+		Columns:  "id, user, itemKind, itemId, stock, isValid",
+		Marker:   "COUNT(*), MAX(id), COALESCE(SUM(stock), 0), COALESCE(SUM(isValid), 0)",
+		Scan: func(rows *sql.Rows) (datasetRow, error) {
+			var i Item
+			return &i, rows.Scan(&i.ID, &i.User, &i.ItemKind, &i.ItemID, &i.Stock, &i.IsValid)
+		},
+	},
+	"characters": {
+		Name:     "characters",
+		GameType: "maimai",
+		Table:    "mai2_item_character",
+		Columns:  "id, user, characterId, level, awakening, useCount",
+		Marker:   "COUNT(*), MAX(id), COALESCE(SUM(level), 0), COALESCE(SUM(awakening), 0), COALESCE(SUM(useCount), 0)",
+		Scan: func(rows *sql.Rows) (datasetRow, error) {
+			var c Character
+			return &c, rows.Scan(&c.ID, &c.User, &c.CharacterID, &c.Level, &c.Awakening, &c.UseCount)
+		},
+	},
+	"maps": {
+		Name:     "maps",
+		GameType: "maimai",
+		Table:    "mai2_item_map",
+		Columns:  "id, user, mapId, distance, isLock, isClear, isComplete",
+		Marker:   "COUNT(*), MAX(id), COALESCE(SUM(distance), 0), COALESCE(SUM(isClear), 0), COALESCE(SUM(isComplete), 0)",
+		Scan: func(rows *sql.Rows) (datasetRow, error) {
+			var m MapProgress
+			return &m, rows.Scan(&m.ID, &m.User, &m.MapID, &m.Distance, &m.IsLock, &m.IsClear, &m.IsComplete)
+		},
+	},
+}
+
+// parseDatasets parses a comma-separated list of dataset names.
+func parseDatasets(s string) ([]*Dataset, error) {
+	var list []*Dataset
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+
+		ds, ok := datasets[name]
+		if !ok {
+			names := lo.Keys(datasets)
+			sort.Strings(names)
+			return nil, errors.Errorf("unknown dataset %q, use %s", name, strings.Join(names, ", "))
+		}
+		if !lo.Contains(list, ds) {
+			list = append(list, ds)
+		}
+	}
+	return list, nil
+}
+
+// datasetState is the cached objects of one dataset, and what a DBUpdater
+// last uploaded of it.
+type datasetState struct {
+	*Dataset
+
+	// markers holds the change marker each user's object was built at.
+	markers map[int64]string
+	objects map[int64]*deltaObject
+	delta   *deltaTarget
+}
+
+func newDatasetState(ds *Dataset, place, game string) *datasetState {
+	return &datasetState{
+		Dataset: ds,
+		markers: make(map[int64]string),
+		objects: make(map[int64]*deltaObject),
+		delta:   newDeltaTarget(ds.Name, fmt.Sprintf("%s-v%d/%s/%s", ds.Name, DatasetVersion, place, game), DatasetVersion),
+	}
+}
+
+func (ds *Dataset) queryMarkers(ctx context.Context, db *sql.DB) (map[int64]string, error) {
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("SELECT user, CONCAT_WS('/', %s) FROM %s GROUP BY user", ds.Marker, ds.Table))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to query %s markers", ds.Name)
+	}
+	defer rows.Close()
+
+	markers := make(map[int64]string)
+	for rows.Next() {
+		var user int64
+		var marker string
+		if err := rows.Scan(&user, &marker); err != nil {
+			return nil, errors.Wrapf(err, "failed to read %s markers", ds.Name)
+		}
+		markers[user] = marker
+	}
+	return markers, errors.Wrapf(rows.Err(), "failed to read %s markers", ds.Name)
+}
+
+// queryRows returns the rows of users, grouped by user and ordered by ID.
+func (ds *Dataset) queryRows(ctx context.Context, db *sql.DB, users []int64) (map[int64][]datasetRow, error) {
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE user IN (?%s) ORDER BY id ASC", ds.Columns, ds.Table, strings.Repeat(", ?", len(users)-1))
+	args := lo.Map(users, func(user int64, _ int) interface{} { return user })
+	if ds.Recent > 0 {
+		// One limited query per user, so only the newest rows are read
+		// through the user index rather than the user's whole history.
+		perUser := fmt.Sprintf("(SELECT %s FROM %s WHERE user = ? ORDER BY id DESC LIMIT %d)", ds.Columns, ds.Table, ds.Recent)
+		query = strings.Repeat(perUser+" UNION ALL ", len(users)-1) + perUser + " ORDER BY id ASC"
+	}
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to query %s", ds.Name)
+	}
+	defer rows.Close()
+
+	byUser := make(map[int64][]datasetRow)
+	for rows.Next() {
+		row, err := ds.Scan(rows)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read %s", ds.Name)
+		}
+		byUser[row.userID()] = append(byUser[row.userID()], row)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrapf(err, "failed to read %s", ds.Name)
+	}
+
+	return byUser, nil
+}
+
+// exportDataset refreshes the objects of users whose rows changed, or of
+// every user on a full sync, and uploads them.
+func (d *DBUpdater) exportDataset(ctx context.Context, ds *datasetState, hidden map[int64]bool, fullSync bool) error {
+	markers, err := ds.queryMarkers(ctx, d.db)
+	if err != nil {
+		return err
+	}
+
+	for user := range ds.objects {
+		if _, ok := markers[user]; !ok {
+			delete(ds.objects, user)
+			delete(ds.markers, user)
+		}
+	}
+
+	var changed []int64
+	for user, marker := range markers {
+		o, ok := ds.objects[user]
+		if fullSync || !ok || ds.markers[user] != marker || o.hidden != hidden[user] {
+			changed = append(changed, user)
+		}
+	}
+	sort.Slice(changed, func(a, b int) bool { return changed[a] < changed[b] })
+
+	for _, batch := range lo.Chunk(changed, dbUserBatchSize) {
+		rows, err := ds.queryRows(ctx, d.db, batch)
+		if err != nil {
+			return err
+		}
+
+		for _, user := range batch {
+			exportedUser := d.Policy.UserID(user)
+			ds.markers[user] = markers[user]
+			if hidden[user] {
+				ds.objects[user] = &deltaObject{hidden: true, user: exportedUser}
+				continue
+			}
+
+			for _, row := range rows[user] {
+				row.setUser(exportedUser)
+			}
+			o, err := newDeltaObject(exportedUser, &DatasetObject{
+				Version: DatasetVersion,
+				Dataset: ds.Name,
+				User:    exportedUser,
+				Rows:    rows[user],
+			})
+			if err != nil {
+				return errors.Wrapf(err, "failed to marshal %s user %d", ds.Name, user)
+			}
+			ds.objects[user] = o
+		}
+	}
+	if len(changed) > 0 {
+		log.Println("db updater:", ds.Name, "refreshed", len(changed), "of", len(markers), "users")
+	}
+
+	return d.exportDelta(ctx, ds.delta, ds.objects)
+}
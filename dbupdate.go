@@ -1,154 +1,367 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"crypto/sha256"
 	"database/sql"
 	"encoding/json"
 	"fmt"
 	"log"
+	"strings"
+	"sync"
 	"time"
 
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/credentials"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/pkg/errors"
+	"github.com/samber/lo"
 	"github.com/urfave/cli/v2"
 )
 
 const RecordVersion = 1
 
-func StartDBUpdater(c *cli.Context) {
-	go func() {
-		dbu := &DBUpdater{
-			Place: c.String("place"),
-			Game:  c.String("name"),
-
-			MySqlDBURL:     c.String("mysql-dburl"),
-			R2AccountID:    c.String("r2-accountid"),
-			R2Bucket:       c.String("r2-bucket"),
-			R2AccountKeyID: c.String("r2-accountkeyid"),
-			R2AccountKey:   c.String("r2-accountkey"),
+// ProfileObserver is called with the profiles of every snapshot read from
+// the DB, whether or not they differ from the previous upload.
+type ProfileObserver func(profiles []*PlayerProfile)
+
+const (
+	dbMaxOpenConns    = 4
+	dbMaxIdleConns    = 2
+	dbConnMaxLifetime = 30 * time.Minute
+	dbConnMaxIdleTime = 5 * time.Minute
+	dbPingTimeout     = 10 * time.Second
+)
+
+// dbFinalFlushTimeout bounds the last export on shutdown.
+const dbFinalFlushTimeout = 30 * time.Second
+
+// StartDBUpdater runs the updater of cab in the background until ctx is
+// done. The returned updater's Done channel yields the result once it has
+// stopped.
+func StartDBUpdater(ctx context.Context, c *cli.Context, cab *Cabinet, observers ...ProfileObserver) (*DBUpdater, error) {
+	exporter, err := NewExporter(c)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to set up exporter")
+	}
+
+	source, err := gameSource(cab.GameType)
+	if err != nil {
+		return nil, err
+	}
+
+	formats, err := source.ExportFormats(c.String("export-formats"))
+	if err != nil {
+		return nil, err
+	}
+
+	sets, err := parseDatasets(c.String("export-datasets"))
+	if err != nil {
+		return nil, err
+	}
+	sets = lo.Filter(sets, func(ds *Dataset, _ int) bool {
+		if ds.GameType != cab.GameType {
+			log.Println("db updater: cabinet", cab.Name, "skips the", ds.Name, "dataset of", ds.GameType)
+			return false
 		}
-		if err := dbu.Start(); err != nil {
-			log.Fatalln(err)
+		return true
+	})
+
+	policy, err := NewExportPolicy(c.String("export-allow-columns"), c.String("export-deny-columns"), c.String("export-pseudonym-key"), source.ProfileColumns)
+	if err != nil {
+		return nil, err
+	}
+	for _, flag := range []string{"export-allow-columns", "export-deny-columns"} {
+		if !c.IsSet(flag) {
+			continue
+		}
+		listed, _ := parseProfileColumns(c.String(flag))
+		if other := lo.Without(listed, source.ProfileColumns...); len(other) > 0 {
+			log.Println("db updater: cabinet", cab.Name, "ignores", flag, strings.Join(other, ","), "which are not", cab.GameType, "profile columns")
 		}
+	}
+
+	dbu := &DBUpdater{
+		Place:     cab.Place,
+		Game:      cab.Game,
+		Exporter:  exporter,
+		Observers: observers,
+
+		MySqlDBURL: cab.MySqlDBURL,
+		ExportFull: c.Bool("export-full"),
+		Source:     source,
+		Formats:    lo.Map(formats, func(f *ExportFormat, _ int) *formatState { return newFormatState(f, cab.Place, cab.Game) }),
+		Datasets:   lo.Map(sets, func(ds *Dataset, _ int) *datasetState { return newDatasetState(ds, cab.Place, cab.Game) }),
+		Policy:     policy,
+		Cards:      cab.Cards,
+
+		done:  make(chan error, 1),
+		users: make(map[int64]*userSnapshot),
+	}
+	go func() {
+		dbu.done <- dbu.Run(ctx)
 	}()
+	return dbu, nil
 }
 
 type DBUpdater struct {
 	Place string
 	Game  string
 
-	MySqlDBURL     string
-	R2AccountID    string
-	R2Bucket       string
-	R2AccountKeyID string
-	R2AccountKey   string
+	MySqlDBURL string
+
+	Exporter  Exporter
+	Observers []ProfileObserver
+	// Source reads the tables of the cabinet's game type.
+	Source *GameSource
+	// ExportFull also uploads the whole content as a single object, as
+	// before delta exports existed, whenever a user changed. It is only
+	// kept until consumers have moved to the delta export.
+	ExportFull bool
+	// Formats are the export formats written side by side.
+	Formats []*formatState
+	// Datasets are the game tables exported next to the ratings.
+	Datasets []*datasetState
+	Policy   *ExportPolicy
+	// Cards is the cabinet's registry; players marked hidden in it are not
+	// exported.
+	Cards *CardRegistry
+
+	// dbMu guards replacing db, which other goroutines read through pool.
+	dbMu sync.RWMutex
+	db   *sql.DB
+	done chan error
+
+	// users caches the rows of every user, refreshed when the user's change
+	// marker moves.
+	users        map[int64]*userSnapshot
+	lastFullSync time.Time
+}
 
-	lastContentSha256 string
+// Done yields the error Run returned once the updater has stopped.
+func (d *DBUpdater) Done() <-chan error {
+	return d.done
 }
 
-func (d *DBUpdater) Start() error {
+// Run exports once, then every minute until ctx is done. Failed exports are
+// logged and retried. On cancellation it flushes a last export and closes
+// the database pool.
+func (d *DBUpdater) Run(ctx context.Context) error {
 	log.Println("mysql db url has been provided and thus db updater has been enabled")
-	if err := d.update(); err != nil {
-		// initial update
+	if err := d.openDB(); err != nil {
 		return err
 	}
+	defer func() {
+		if err := d.Close(); err != nil {
+			log.Println("db updater: failed to close db:", err)
+		}
+	}()
 
-	go func() {
-		// update after 1 minute of each previous update
-		for {
-			time.Sleep(1 * time.Minute)
+	// A failing first export, e.g. while MySQL or the bucket is still
+	// starting, is retried on the interval like any later one.
+	if err := d.update(ctx); err != nil {
+		log.Println("db updater: initial export failed, retrying in a minute:", err)
+	}
 
-			if err := d.update(); err != nil {
-				log.Println(err)
-			}
+	// update after 1 minute of each previous update
+	for {
+		select {
+		case <-ctx.Done():
+			log.Println("db updater: flushing last export before shutdown")
+			flushCtx, cancel := context.WithTimeout(context.Background(), dbFinalFlushTimeout)
+			defer cancel()
+			return d.update(flushCtx)
+		case <-time.After(1 * time.Minute):
 		}
-	}()
+
+		if err := d.update(ctx); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+func (d *DBUpdater) openDB() error {
+	db, err := sql.Open("mysql", d.MySqlDBURL)
+	if err != nil {
+		return errors.Wrap(err, "failed to open mysql db")
+	}
+
+	db.SetMaxOpenConns(dbMaxOpenConns)
+	db.SetMaxIdleConns(dbMaxIdleConns)
+	db.SetConnMaxLifetime(dbConnMaxLifetime)
+	db.SetConnMaxIdleTime(dbConnMaxIdleTime)
+
+	d.dbMu.Lock()
+	d.db = db
+	d.dbMu.Unlock()
 	return nil
 }
 
+// pool returns the database pool for use outside the updater's goroutine.
+func (d *DBUpdater) pool() (*sql.DB, error) {
+	d.dbMu.RLock()
+	defer d.dbMu.RUnlock()
+
+	if d.db == nil {
+		return nil, errors.New("db updater has not connected yet")
+	}
+	return d.db, nil
+}
+
+// LatestRatingRecord returns the rating record of the newest game version
+// played with cardNum, or nil if the card has not played.
+func (d *DBUpdater) LatestRatingRecord(ctx context.Context, cardNum string) (*RatingRecord, error) {
+	db, err := d.pool()
+	if err != nil {
+		return nil, err
+	}
+
+	var user int64
+	err = db.QueryRowContext(ctx, "SELECT user FROM aime_card WHERE access_code = ?", cardNum).Scan(&user)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to query aime card")
+	}
+
+	records, err := queryRatingRecords(ctx, db, "user = ?", user)
+	if err != nil {
+		return nil, err
+	}
+	return lo.MaxBy(records, func(a, b *RatingRecord) bool { return a.Version > b.Version }), nil
+}
+
+// ensureDB pings the database and reopens the pool if the ping fails, so a
+// restarted MySQL server does not leave the updater stuck on dead
+// connections.
+func (d *DBUpdater) ensureDB(ctx context.Context) error {
+	pingCtx, cancel := context.WithTimeout(ctx, dbPingTimeout)
+	defer cancel()
+
+	err := d.db.PingContext(pingCtx)
+	if err == nil {
+		return nil
+	}
+
+	log.Println("db updater: health check failed, reconnecting:", err)
+
+	if err := d.db.Close(); err != nil {
+		log.Println("db updater: failed to close stale pool:", err)
+	}
+	if err := d.openDB(); err != nil {
+		return err
+	}
+
+	pingCtx, cancel = context.WithTimeout(ctx, dbPingTimeout)
+	defer cancel()
+
+	return errors.Wrap(d.db.PingContext(pingCtx), "failed to reconnect to mysql db")
+}
+
+// Close releases the database pool.
+func (d *DBUpdater) Close() error {
+	if d.db == nil {
+		return nil
+	}
+	return d.db.Close()
+}
+
 type Content struct {
 	RatingRecords  []*RatingRecord  `json:"rating_records"`
 	ProfileDetails []*ProfileDetail `json:"profile_details"`
 	Version        int              `json:"version"`
 }
 
-func (d *DBUpdater) update() error {
-	bucketName := d.R2Bucket
-	accountId := d.R2AccountID
-	accessKeyId := d.R2AccountKeyID
-	accessKeySecret := d.R2AccountKey
+func (d *DBUpdater) update(ctx context.Context) error {
+	if err := d.ensureDB(ctx); err != nil {
+		return err
+	}
 
-	u := fmt.Sprintf("https://%s.r2.cloudflarestorage.com", accountId)
+	hidden, err := queryHiddenUsers(ctx, d.db, d.Cards.HiddenCards())
+	if err != nil {
+		return err
+	}
+	fullSync := time.Since(d.lastFullSync) >= dbFullSyncInterval
 
-	log.Println("updating db: formatted r2 url:", u)
+	changed, err := d.refresh(ctx, hidden, fullSync)
+	if err != nil {
+		return errors.Wrap(err, "failed to get content")
+	}
+	profiles := d.profiles()
+	for _, observe := range d.Observers {
+		observe(profiles)
+	}
 
-	r2Resolver := aws.EndpointResolverWithOptionsFunc(func(service, region string, options ...interface{}) (aws.Endpoint, error) {
-		return aws.Endpoint{
-			URL: u,
-		}, nil
-	})
+	exported := d.exportedUsers()
+	for _, f := range d.Formats {
+		if err := d.exportSchema(ctx, f); err != nil {
+			return err
+		}
+		f.fullStale = f.fullStale || changed
+		if d.ExportFull && f.fullStale {
+			if err := d.exportFull(ctx, f, exported); err != nil {
+				return err
+			}
+		}
+		objects := lo.MapValues(d.users, func(snap *userSnapshot, _ int64) *deltaObject { return snap.objects[f.Name] })
+		if err := d.exportDelta(ctx, f.delta, objects); err != nil {
+			return err
+		}
+	}
 
-	cfg, err := config.LoadDefaultConfig(context.TODO(),
-		config.WithEndpointResolverWithOptions(r2Resolver),
-		config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(accessKeyId, accessKeySecret, "")),
-		config.WithRegion("us-east-1"),
-	)
-	if err != nil {
-		return errors.Wrap(err, "failed to load aws config")
+	for _, ds := range d.Datasets {
+		if err := d.exportDataset(ctx, ds, hidden, fullSync); err != nil {
+			return err
+		}
 	}
 
-	client := s3.NewFromConfig(cfg)
+	if fullSync {
+		d.lastFullSync = time.Now()
+	}
+	return nil
+}
 
-	db, err := sql.Open("mysql", d.MySqlDBURL)
-	if err != nil {
-		return errors.Wrap(err, "failed to open mysql db")
+// exportSchema uploads the format's JSON Schema once per run.
+func (d *DBUpdater) exportSchema(ctx context.Context, f *formatState) error {
+	if f.Schema == nil || f.schemaPublished {
+		return nil
 	}
 
-	content, err := d.getContent(db)
-	if err != nil {
-		return errors.Wrap(err, "failed to get content")
+	if err := d.Exporter.Put(ctx, f.Prefix+"/schema.json", f.Schema, "application/schema+json"); err != nil {
+		return errors.Wrapf(err, "failed to upload %s schema", f.Name)
 	}
+	f.schemaPublished = true
+	return nil
+}
 
+// exportFull uploads the user objects as a single object if it changed
+// since the last upload.
+func (d *DBUpdater) exportFull(ctx context.Context, f *formatState, users []GameUser) error {
 	// marshal to json
-	b, err := json.Marshal(content)
+	b, err := json.Marshal(f.Content(users, d.Place, d.Game))
 	if err != nil {
-		return errors.Wrap(err, "failed to marshal content")
+		return errors.Wrapf(err, "failed to marshal %s content", f.Name)
 	}
 
 	// calculate sha256
 	currentSha := fmt.Sprintf("%x", sha256.Sum256(b))
-	if currentSha == d.lastContentSha256 {
-		log.Println("no update: sha256 is same as previous:", currentSha)
+	if currentSha == f.lastContentSha256 {
+		log.Println("no update:", f.Name, "sha256 is same as previous:", currentSha)
 		// no update
+		f.fullStale = false
 		return nil
 	}
 
-	// new string buffer
-	buf := bytes.NewBuffer(b)
+	log.Println("db updating:", f.Name, currentSha)
 
-	log.Println("db updating:", currentSha)
-
-	// upload to s3
-	_, err = client.PutObject(context.TODO(), &s3.PutObjectInput{
-		Bucket:      aws.String(bucketName),
-		Key:         aws.String(fmt.Sprintf("ratings-v0/%s/%s.json", d.Place, d.Game)),
-		Body:        buf,
-		ContentType: aws.String("application/json"),
-	})
-	if err != nil {
-		return errors.Wrap(err, "failed to upload to s3")
+	if err := d.Exporter.Put(ctx, fmt.Sprintf("%s/%s/%s.json", f.Prefix, d.Place, d.Game), b, "application/json"); err != nil {
+		return err
 	}
 
 	// update last sha256
-	d.lastContentSha256 = currentSha
+	f.lastContentSha256 = currentSha
+	f.fullStale = false
 
-	log.Println("db updated:", currentSha)
+	log.Println("db updated:", f.Name, currentSha)
 
 	return nil
 }
@@ -247,10 +460,21 @@ type ProfileDetail struct {
 	PlayerNewRating          int64           `json:"playerNewRating"`
 	DateTime                 int64           `json:"dateTime"`
 	BanState                 int64           `json:"banState"`
+
+	// omit holds the columns left out when marshalling, set by the export
+	// policy.
+	omit map[string]bool
+}
+
+func (p *ProfileDetail) MarshalJSON() ([]byte, error) {
+	type plain ProfileDetail
+	return marshalWithout((*plain)(p), p.omit)
 }
 
-func (d *DBUpdater) getContent(db *sql.DB) (*Content, error) {
-	ratingRecordRows, err := db.Query("SELECT id, user, version, rating, ratingList, newRatingList, nextRatingList, nextNewRatingList, udemae FROM mai2_profile_rating ORDER BY id ASC")
+// queryRatingRecords returns the rating records matching the SQL condition
+// where, e.g. "user IN (?, ?)".
+func queryRatingRecords(ctx context.Context, db *sql.DB, where string, args ...interface{}) ([]*RatingRecord, error) {
+	ratingRecordRows, err := db.QueryContext(ctx, "SELECT id, user, version, rating, ratingList, newRatingList, nextRatingList, nextNewRatingList, udemae FROM mai2_profile_rating WHERE "+where+" ORDER BY id ASC", args...)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to query rating records")
 	}
@@ -265,9 +489,14 @@ func (d *DBUpdater) getContent(db *sql.DB) (*Content, error) {
 		ratingRecords = append(ratingRecords, &r)
 	}
 
-	profileDetailRows, err := db.Query("SELECT id, user, version, userName, isNetMember, iconId, plateId, titleId, partnerId, frameId, selectMapId, totalAwake, gradeRating, musicRating, playerRating, highestRating, gradeRank, classRank, courseRank, charaSlot, charaLockSlot, contentBit, playCount, currentPlayCount, renameCredit, mapStock, eventWatchedDate, lastGameId, lastRomVersion, lastDataVersion, lastLoginDate, lastPairLoginDate, lastPlayDate, lastTrialPlayDate, lastPlayCredit, lastPlayMode, lastPlaceId, lastPlaceName, lastAllNetId, lastRegionId, lastRegionName, lastClientId, lastCountryCode, lastSelectEMoney, lastSelectTicket, lastSelectCourse, lastCountCourse, firstGameId, firstRomVersion, firstDataVersion, firstPlayDate, compatibleCmVersion, dailyBonusDate, dailyCourseBonusDate, playVsCount, playSyncCount, winCount, helpCount, comboCount, totalDeluxscore, totalBasicDeluxscore, totalAdvancedDeluxscore, totalExpertDeluxscore, totalMasterDeluxscore, totalReMasterDeluxscore, totalSync, totalBasicSync, totalAdvancedSync, totalExpertSync, totalMasterSync, totalReMasterSync, totalAchievement, totalBasicAchievement, totalAdvancedAchievement, totalExpertAchievement, totalMasterAchievement, totalReMasterAchievement, playerOldRating, playerNewRating, dateTime, banState FROM mai2_profile_detail ORDER BY id ASC")
+	return ratingRecords, errors.Wrap(ratingRecordRows.Err(), "failed to read rating records")
+}
+
+// queryProfileDetails returns the profiles matching the SQL condition where.
+func queryProfileDetails(ctx context.Context, db *sql.DB, where string, args ...interface{}) ([]*ProfileDetail, error) {
+	profileDetailRows, err := db.QueryContext(ctx, "SELECT id, user, version, userName, isNetMember, iconId, plateId, titleId, partnerId, frameId, selectMapId, totalAwake, gradeRating, musicRating, playerRating, highestRating, gradeRank, classRank, courseRank, charaSlot, charaLockSlot, contentBit, playCount, currentPlayCount, renameCredit, mapStock, eventWatchedDate, lastGameId, lastRomVersion, lastDataVersion, lastLoginDate, lastPairLoginDate, lastPlayDate, lastTrialPlayDate, lastPlayCredit, lastPlayMode, lastPlaceId, lastPlaceName, lastAllNetId, lastRegionId, lastRegionName, lastClientId, lastCountryCode, lastSelectEMoney, lastSelectTicket, lastSelectCourse, lastCountCourse, firstGameId, firstRomVersion, firstDataVersion, firstPlayDate, compatibleCmVersion, dailyBonusDate, dailyCourseBonusDate, playVsCount, playSyncCount, winCount, helpCount, comboCount, totalDeluxscore, totalBasicDeluxscore, totalAdvancedDeluxscore, totalExpertDeluxscore, totalMasterDeluxscore, totalReMasterDeluxscore, totalSync, totalBasicSync, totalAdvancedSync, totalExpertSync, totalMasterSync, totalReMasterSync, totalAchievement, totalBasicAchievement, totalAdvancedAchievement, totalExpertAchievement, totalMasterAchievement, totalReMasterAchievement, playerOldRating, playerNewRating, dateTime, banState FROM mai2_profile_detail WHERE "+where+" ORDER BY id ASC", args...)
 	if err != nil {
-		return nil, err
+		return nil, errors.Wrap(err, "failed to query profile details")
 	}
 	defer profileDetailRows.Close()
 
@@ -280,9 +509,5 @@ func (d *DBUpdater) getContent(db *sql.DB) (*Content, error) {
 		profileDetails = append(profileDetails, &p)
 	}
 
-	return &Content{
-		RatingRecords:  ratingRecords,
-		ProfileDetails: profileDetails,
-		Version:        RecordVersion,
-	}, nil
+	return profileDetails, errors.Wrap(profileDetailRows.Err(), "failed to read profile details")
 }
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/samber/lo"
+)
+
+// A delta export publishes one object per user plus a manifest listing the
+// hash of every user object, below the prefix of each export format and
+// dataset:
+//
+//	<prefix>/<place>/<game>/manifest.json
+//	<prefix>/<place>/<game>/users/<user>.json
+//
+// Consumers fetch the manifest and only the user objects whose hash
+// changed. Only users whose rows changed are read from the DB and uploaded.
+const (
+	// dbFullSyncInterval re-reads every row now and then, to catch changes
+	// that do not move a user's change marker.
+	dbFullSyncInterval = 1 * time.Hour
+	// dbUserBatchSize bounds the number of users read in one query.
+	dbUserBatchSize = 200
+)
+
+// userSnapshot is the cached rows of one user. Unless the user is hidden,
+// it also holds the user object as the export policy lets it out, and its
+// delta object in every export format.
+type userSnapshot struct {
+	marker   string
+	hidden   bool
+	obj      GameUser
+	exported GameUser
+	objects  map[string]*deltaObject
+}
+
+// UserObject is the per-user object of a delta export.
+type UserObject struct {
+	User           int64            `json:"user"`
+	RatingRecords  []*RatingRecord  `json:"rating_records"`
+	ProfileDetails []*ProfileDetail `json:"profile_details"`
+	Version        int              `json:"version"`
+}
+
+type DeltaManifest struct {
+	Version   int                  `json:"version"`
+	UpdatedAt time.Time            `json:"updatedAt"`
+	Users     []*DeltaManifestUser `json:"users"`
+}
+
+type DeltaManifestUser struct {
+	User      int64     `json:"user"`
+	Key       string    `json:"key"`
+	Hash      string    `json:"hash"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// deltaTarget is what a DBUpdater last uploaded below one key prefix, e.g.
+// ratings-v0/<place>/<game>.
+type deltaTarget struct {
+	name    string
+	prefix  string
+	version int
+
+	// published holds the hash of each user object last uploaded.
+	published map[int64]*publishedUser
+	// withdrawn holds the hidden users whose objects were deleted.
+	withdrawn map[int64]bool
+
+	manifestDirty bool
+}
+
+func newDeltaTarget(name, prefix string, version int) *deltaTarget {
+	return &deltaTarget{
+		name:      name,
+		prefix:    prefix,
+		version:   version,
+		published: make(map[int64]*publishedUser),
+		withdrawn: make(map[int64]bool),
+	}
+}
+
+func (t *deltaTarget) userKey(user int64) string {
+	return fmt.Sprintf("%s/users/%d.json", t.prefix, user)
+}
+
+// deltaObject is the current object of one user, keyed by its exported ID.
+// The object of a hidden user has no body and is withdrawn.
+type deltaObject struct {
+	hidden bool
+	user   int64
+	body   []byte
+	hash   string
+}
+
+func newDeltaObject(user int64, v interface{}) (*deltaObject, error) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return &deltaObject{user: user, body: body, hash: fmt.Sprintf("%x", sha256.Sum256(body))}, nil
+}
+
+// publishedUser is what was last uploaded for a user.
+type publishedUser struct {
+	user int64
+	key  string
+	hash string
+	at   time.Time
+}
+
+// queryUserMarkers returns a change marker for every user. The marker moves
+// whenever a play is recorded: the profile's dateTime, lastPlayDate and play
+// count change, and new rating rows get new IDs.
+func queryUserMarkers(ctx context.Context, db *sql.DB) (map[int64]string, error) {
+	markers := make(map[int64]string)
+
+	rows, err := db.QueryContext(ctx, "SELECT user, COUNT(*), COALESCE(MAX(dateTime), 0), COALESCE(MAX(lastPlayDate), ''), COALESCE(SUM(playCount), 0) FROM mai2_profile_detail GROUP BY user")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to query profile markers")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var user, count, dateTime, playCount int64
+		var lastPlayDate string
+		if err := rows.Scan(&user, &count, &dateTime, &lastPlayDate, &playCount); err != nil {
+			return nil, errors.Wrap(err, "failed to read profile markers")
+		}
+		markers[user] = fmt.Sprintf("p:%d/%d/%s/%d", count, dateTime, lastPlayDate, playCount)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to read profile markers")
+	}
+
+	ratingRows, err := db.QueryContext(ctx, "SELECT user, COUNT(*), MAX(id) FROM mai2_profile_rating GROUP BY user")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to query rating markers")
+	}
+	defer ratingRows.Close()
+
+	for ratingRows.Next() {
+		var user, count, maxID int64
+		if err := ratingRows.Scan(&user, &count, &maxID); err != nil {
+			return nil, errors.Wrap(err, "failed to read rating markers")
+		}
+		markers[user] += fmt.Sprintf(" r:%d/%d", count, maxID)
+	}
+
+	return markers, errors.Wrap(ratingRows.Err(), "failed to read rating markers")
+}
+
+// refresh updates the cached rows of every user whose change marker or
+// hidden flag moved, or of every user on a full sync. It reports whether any
+// user was refreshed or removed.
+func (d *DBUpdater) refresh(ctx context.Context, hidden map[int64]bool, fullSync bool) (bool, error) {
+	markers, err := d.Source.QueryMarkers(ctx, d.db)
+	if err != nil {
+		return false, err
+	}
+
+	removed := false
+	for user := range d.users {
+		if _, ok := markers[user]; !ok {
+			delete(d.users, user)
+			removed = true
+		}
+	}
+
+	var changed []int64
+	for user, marker := range markers {
+		if snap, ok := d.users[user]; fullSync || !ok || snap.marker != marker || snap.hidden != hidden[user] {
+			changed = append(changed, user)
+		}
+	}
+	if len(changed) == 0 {
+		return removed, nil
+	}
+	sort.Slice(changed, func(a, b int) bool { return changed[a] < changed[b] })
+
+	for _, batch := range lo.Chunk(changed, dbUserBatchSize) {
+		if err := d.refreshUsers(ctx, batch, markers, hidden); err != nil {
+			return false, err
+		}
+	}
+
+	log.Println("db updater: refreshed", len(changed), "of", len(markers), "users")
+	return true, nil
+}
+
+func (d *DBUpdater) refreshUsers(ctx context.Context, users []int64, markers map[int64]string, hidden map[int64]bool) error {
+	objs, err := d.Source.QueryUsers(ctx, d.db, users)
+	if err != nil {
+		return err
+	}
+
+	for _, user := range users {
+		snap := &userSnapshot{
+			marker:  markers[user],
+			hidden:  hidden[user],
+			obj:     objs[user],
+			objects: make(map[string]*deltaObject, len(d.Formats)),
+		}
+		d.users[user] = snap
+		if snap.hidden {
+			for _, f := range d.Formats {
+				snap.objects[f.Name] = &deltaObject{hidden: true, user: d.Policy.UserID(user)}
+			}
+			continue
+		}
+
+		snap.exported = snap.obj.Export(d.Policy)
+		exportedUser := d.Policy.UserID(user)
+		for _, f := range d.Formats {
+			o, err := newDeltaObject(exportedUser, f.User(snap.exported))
+			if err != nil {
+				return errors.Wrapf(err, "failed to marshal %s user %d", f.Name, user)
+			}
+			snap.objects[f.Name] = o
+		}
+	}
+
+	return nil
+}
+
+// profiles returns the profiles of every user, hidden ones flagged.
+func (d *DBUpdater) profiles() []*PlayerProfile {
+	var profiles []*PlayerProfile
+	for _, snap := range d.users {
+		for _, p := range snap.obj.PlayerProfiles() {
+			p.Hidden = snap.hidden
+			profiles = append(profiles, p)
+		}
+	}
+	return profiles
+}
+
+// exportedUsers returns the user objects the export policy lets out,
+// ordered by user.
+func (d *DBUpdater) exportedUsers() []GameUser {
+	users := lo.Keys(d.users)
+	sort.Slice(users, func(a, b int) bool { return users[a] < users[b] })
+
+	var objs []GameUser
+	for _, user := range users {
+		if snap := d.users[user]; snap.exported != nil {
+			objs = append(objs, snap.exported)
+		}
+	}
+	return objs
+}
+
+// exportDelta uploads the objects that changed since their last upload,
+// withdraws those of removed and hidden users, then uploads the manifest.
+// objects is keyed by DB user. A failed upload is retried on the next run.
+func (d *DBUpdater) exportDelta(ctx context.Context, t *deltaTarget, objects map[int64]*deltaObject) error {
+	users := lo.Keys(objects)
+	sort.Slice(users, func(a, b int) bool { return users[a] < users[b] })
+
+	uploaded := 0
+	for _, user := range users {
+		o := objects[user]
+		if o.hidden {
+			continue
+		}
+		if prev, ok := t.published[user]; ok && prev.hash == o.hash {
+			continue
+		}
+
+		key := t.userKey(o.user)
+		if err := d.Exporter.Put(ctx, key, o.body, "application/json"); err != nil {
+			return errors.Wrapf(err, "failed to upload %s user %d", t.name, user)
+		}
+		t.published[user] = &publishedUser{user: o.user, key: key, hash: o.hash, at: time.Now()}
+		delete(t.withdrawn, user)
+		t.manifestDirty = true
+		uploaded++
+	}
+
+	if err := d.withdraw(ctx, t, objects); err != nil {
+		return err
+	}
+
+	if !t.manifestDirty {
+		return nil
+	}
+
+	manifest := &DeltaManifest{
+		Version:   t.version,
+		UpdatedAt: time.Now(),
+		Users:     make([]*DeltaManifestUser, 0, len(users)),
+	}
+	for _, user := range users {
+		if pub, ok := t.published[user]; ok {
+			manifest.Users = append(manifest.Users, &DeltaManifestUser{
+				User:      pub.user,
+				Key:       pub.key,
+				Hash:      pub.hash,
+				UpdatedAt: pub.at,
+			})
+		}
+	}
+
+	b, err := json.Marshal(manifest)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal manifest")
+	}
+	if err := d.Exporter.Put(ctx, t.prefix+"/manifest.json", b, "application/json"); err != nil {
+		return errors.Wrapf(err, "failed to upload %s manifest", t.name)
+	}
+	t.manifestDirty = false
+
+	log.Println("db updater:", t.name, "delta export uploaded", uploaded, "users and the manifest of", len(manifest.Users), "users")
+	return nil
+}
+
+// withdraw deletes the objects of users that were removed from the DB, and
+// those of hidden users. Hidden users are withdrawn once per run even if
+// nothing was published for them, as an earlier run may have.
+func (d *DBUpdater) withdraw(ctx context.Context, t *deltaTarget, objects map[int64]*deltaObject) error {
+	for user, pub := range t.published {
+		o, ok := objects[user]
+		if ok && !o.hidden {
+			continue
+		}
+
+		if err := d.Exporter.Delete(ctx, pub.key); err != nil {
+			return errors.Wrapf(err, "failed to withdraw %s user %d", t.name, user)
+		}
+		delete(t.published, user)
+		t.manifestDirty = true
+		if ok && pub.key == t.userKey(o.user) {
+			t.withdrawn[user] = true
+		}
+	}
+
+	for user, o := range objects {
+		if !o.hidden || t.withdrawn[user] {
+			continue
+		}
+
+		if err := d.Exporter.Delete(ctx, t.userKey(o.user)); err != nil {
+			return errors.Wrapf(err, "failed to withdraw %s user %d", t.name, user)
+		}
+		t.withdrawn[user] = true
+		log.Println("db updater:", t.name, "withdrew the export of hidden user", user)
+	}
+
+	return nil
+}
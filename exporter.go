@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+)
+
+// Exporter publishes an exported object under a slash-separated key such as
+// "ratings-v0/<place>/<game>.json". Delete withdraws an object; deleting a
+// missing object is not an error.
+type Exporter interface {
+	Put(ctx context.Context, key string, body []byte, contentType string) error
+	Delete(ctx context.Context, key string) error
+}
+
+// NewExporter builds the exporter selected by --export-backend.
+func NewExporter(c *cli.Context) (Exporter, error) {
+	switch backend := c.String("export-backend"); backend {
+	case "r2":
+		return NewS3Exporter(&S3ExporterConfig{
+			Endpoint:        fmt.Sprintf("https://%s.r2.cloudflarestorage.com", c.String("r2-accountid")),
+			Region:          "us-east-1",
+			Bucket:          c.String("r2-bucket"),
+			AccessKeyID:     c.String("r2-accountkeyid"),
+			SecretAccessKey: c.String("r2-accountkey"),
+		})
+	case "s3":
+		return NewS3Exporter(&S3ExporterConfig{
+			Endpoint:        c.String("s3-endpoint"),
+			Region:          c.String("s3-region"),
+			Bucket:          c.String("s3-bucket"),
+			AccessKeyID:     c.String("s3-accesskeyid"),
+			SecretAccessKey: c.String("s3-secretaccesskey"),
+			UsePathStyle:    c.Bool("s3-path-style"),
+		})
+	case "file":
+		return NewFileExporter(c.Path("export-dir"))
+	case "webhook":
+		return NewWebhookExporter(c.String("webhook-url"), c.String("webhook-method"), c.String("webhook-token"))
+	default:
+		return nil, errors.Errorf("unknown export backend %q", backend)
+	}
+}
+
+type S3ExporterConfig struct {
+	// Endpoint overrides the AWS endpoint, e.g. for R2 or MinIO. Leave empty
+	// for AWS S3.
+	Endpoint        string
+	Region          string
+	Bucket          string
+	AccessKeyID     string
+	SecretAccessKey string
+	// UsePathStyle addresses objects as <endpoint>/<bucket>/<key>, which
+	// MinIO and most self-hosted S3 servers need.
+	UsePathStyle bool
+}
+
+// S3Exporter uploads objects to an S3 compatible bucket.
+type S3Exporter struct {
+	client *s3.Client
+	bucket string
+}
+
+func NewS3Exporter(cfg *S3ExporterConfig) (*S3Exporter, error) {
+	if cfg.Bucket == "" {
+		return nil, errors.New("s3 exporter: bucket is required")
+	}
+
+	opts := []func(*config.LoadOptions) error{
+		config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(cfg.AccessKeyID, cfg.SecretAccessKey, "")),
+		config.WithRegion(cfg.Region),
+	}
+	if cfg.Endpoint != "" {
+		opts = append(opts, config.WithEndpointResolverWithOptions(aws.EndpointResolverWithOptionsFunc(func(service, region string, options ...interface{}) (aws.Endpoint, error) {
+			return aws.Endpoint{
+				URL: cfg.Endpoint,
+			}, nil
+		})))
+	}
+
+	awsCfg, err := config.LoadDefaultConfig(context.TODO(), opts...)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load aws config")
+	}
+
+	client := s3.NewFromConfig(awsCfg, func(o *s3.Options) {
+		o.UsePathStyle = cfg.UsePathStyle
+	})
+
+	return &S3Exporter{client: client, bucket: cfg.Bucket}, nil
+}
+
+func (e *S3Exporter) Put(ctx context.Context, key string, body []byte, contentType string) error {
+	_, err := e.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(e.bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String(contentType),
+	})
+	return errors.Wrap(err, "failed to upload to s3")
+}
+
+func (e *S3Exporter) Delete(ctx context.Context, key string) error {
+	_, err := e.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(e.bucket),
+		Key:    aws.String(key),
+	})
+	return errors.Wrap(err, "failed to delete from s3")
+}
+
+// FileExporter writes objects below a local directory, mirroring the key
+// as a relative path.
+type FileExporter struct {
+	dir string
+}
+
+func NewFileExporter(dir string) (*FileExporter, error) {
+	if dir == "" {
+		return nil, errors.New("file exporter: export dir is required")
+	}
+	return &FileExporter{dir: dir}, nil
+}
+
+func (e *FileExporter) path(key string) (string, error) {
+	path := filepath.Join(e.dir, filepath.FromSlash(key))
+	if !strings.HasPrefix(path, filepath.Clean(e.dir)+string(filepath.Separator)) {
+		return "", errors.Errorf("file exporter: key %q escapes the export dir", key)
+	}
+	return path, nil
+}
+
+func (e *FileExporter) Put(ctx context.Context, key string, body []byte, contentType string) error {
+	path, err := e.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return errors.Wrap(err, "failed to create export dir")
+	}
+
+	return errors.Wrap(writeFileAtomic(path, body), "failed to write export file")
+}
+
+func (e *FileExporter) Delete(ctx context.Context, key string) error {
+	path, err := e.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "failed to delete export file")
+	}
+	return nil
+}
+
+// WebhookExporter sends each object to <url>/<key> with an HTTP PUT or
+// POST request, and withdraws it with a DELETE request.
+type WebhookExporter struct {
+	url    string
+	method string
+	token  string
+	client *http.Client
+}
+
+func NewWebhookExporter(url, method, token string) (*WebhookExporter, error) {
+	if url == "" {
+		return nil, errors.New("webhook exporter: url is required")
+	}
+
+	method = strings.ToUpper(method)
+	if method != http.MethodPut && method != http.MethodPost {
+		return nil, errors.Errorf("webhook exporter: unsupported method %q", method)
+	}
+
+	return &WebhookExporter{
+		url:    strings.TrimSuffix(url, "/"),
+		method: method,
+		token:  token,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+func (e *WebhookExporter) Put(ctx context.Context, key string, body []byte, contentType string) error {
+	return e.send(ctx, e.method, key, bytes.NewReader(body), contentType)
+}
+
+func (e *WebhookExporter) Delete(ctx context.Context, key string) error {
+	err := e.send(ctx, http.MethodDelete, key, nil, "")
+	if errors.Is(err, errWebhookNotFound) {
+		return nil
+	}
+	return err
+}
+
+var errWebhookNotFound = errors.New("webhook responded with 404 Not Found")
+
+func (e *WebhookExporter) send(ctx context.Context, method, key string, body io.Reader, contentType string) error {
+	req, err := http.NewRequestWithContext(ctx, method, e.url+"/"+key, body)
+	if err != nil {
+		return errors.Wrap(err, "failed to build webhook request")
+	}
+
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if e.token != "" {
+		req.Header.Set("Authorization", "Bearer "+e.token)
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "failed to send webhook request")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return errWebhookNotFound
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return errors.Errorf("webhook responded with %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	return nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/samber/lo"
+)
+
+// ExportFormat is a layout of the exported ratings of maimai. Several formats can be
+// written side by side, each below its own key prefix, so consumers can move
+// to a new format while the old one is still published.
+type ExportFormat struct {
+	Name string
+	// Prefix is the first element of every key, e.g. ratings-v0.
+	Prefix  string
+	Version int
+	// Content converts the user objects, ordered by user, for the full
+	// export.
+	Content func(users []GameUser, place, game string) interface{}
+	// User converts a per-user object for the delta export.
+	User func(obj GameUser) interface{}
+	// Schema is published at <prefix>/schema.json if set.
+	Schema []byte
+}
+
+var exportFormats = map[string]*ExportFormat{
+	"v1": {
+		Name:    "v1",
+		Prefix:  "ratings-v0",
+		Version: RecordVersion,
+		Content: func(users []GameUser, _, _ string) interface{} { return mai2Content(users) },
+		User:    func(obj GameUser) interface{} { return obj },
+	},
+	"v2": {
+		Name:    "v2",
+		Prefix:  "ratings-v2",
+		Version: RecordVersionV2,
+		Content: func(users []GameUser, place, game string) interface{} {
+			return NewContentV2(mai2Content(users), place, game)
+		},
+		User:   func(obj GameUser) interface{} { return NewUserObjectV2(obj.(*UserObject)) },
+		Schema: ratingsV2Schema,
+	},
+}
+
+// parseExportFormats parses a comma-separated list of format names.
+func parseExportFormats(s string) ([]*ExportFormat, error) {
+	var formats []*ExportFormat
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+
+		f, ok := exportFormats[name]
+		if !ok {
+			return nil, errors.Errorf("unknown export format %q, use v1 or v2", name)
+		}
+		if !lo.Contains(formats, f) {
+			formats = append(formats, f)
+		}
+	}
+	if len(formats) == 0 {
+		return nil, errors.New("export-formats must name at least one format")
+	}
+	return formats, nil
+}
+
+// formatState is what a DBUpdater last uploaded in one format.
+type formatState struct {
+	*ExportFormat
+
+	lastContentSha256 string
+	schemaPublished   bool
+	// fullStale is set while the users changed since the last full export.
+	fullStale bool
+	delta     *deltaTarget
+}
+
+func newFormatState(f *ExportFormat, place, game string) *formatState {
+	return &formatState{
+		ExportFormat: f,
+		fullStale:    true,
+		delta:        newDeltaTarget(f.Name, fmt.Sprintf("%s/%s/%s", f.Prefix, place, game), f.Version),
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/samber/lo"
+)
+
+// defaultExportDenyColumns are the mai2_profile_detail columns that can
+// locate a player or tell about their account, and are left out of the
+// export unless configured otherwise.
+const defaultExportDenyColumns = "lastClientId,lastAllNetId,lastRegionName,banState,lastCountryCode,lastPlaceName"
+
+// exportKeyColumns identify a row and are always exported.
+var exportKeyColumns = []string{"id", "user", "version"}
+
+// profileDetailColumns are the JSON names of the ProfileDetail fields.
+var profileDetailColumns = jsonFieldNames(reflect.TypeOf(ProfileDetail{}))
+
+// allProfileColumns are the profile columns of every game type, which the
+// column lists are checked against.
+func allProfileColumns() []string {
+	var names []string
+	for _, src := range gameSources {
+		names = append(names, src.ProfileColumns...)
+	}
+	return lo.Uniq(names)
+}
+
+func jsonFieldNames(t reflect.Type) []string {
+	var names []string
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name != "" && name != "-" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// ExportPolicy decides which data leaves the server: it drops profile
+// columns and replaces user IDs with pseudonyms. Players marked hidden in
+// record.txt are left out by the DBUpdater before the policy applies.
+type ExportPolicy struct {
+	// omit holds the profile columns left out, by JSON name.
+	omit map[string]bool
+	// pseudonymKey keys the hash replacing user IDs. Without a key the IDs
+	// are exported as is.
+	pseudonymKey []byte
+}
+
+// NewExportPolicy builds a policy for the profile columns of a game from
+// comma-separated column lists. A non-empty allow list takes precedence over
+// the deny list. Listed columns of other games do not apply.
+func NewExportPolicy(allow, deny, pseudonymKey string, columns []string) (*ExportPolicy, error) {
+	p := &ExportPolicy{omit: make(map[string]bool)}
+	if pseudonymKey != "" {
+		p.pseudonymKey = []byte(pseudonymKey)
+	}
+
+	allowed, err := parseProfileColumns(allow)
+	if err != nil {
+		return nil, errors.Wrap(err, "export-allow-columns")
+	}
+	denied, err := parseProfileColumns(deny)
+	if err != nil {
+		return nil, errors.Wrap(err, "export-deny-columns")
+	}
+
+	for _, name := range columns {
+		if lo.Contains(exportKeyColumns, name) {
+			continue
+		}
+		if len(allowed) > 0 {
+			p.omit[name] = !lo.Contains(allowed, name)
+		} else {
+			p.omit[name] = lo.Contains(denied, name)
+		}
+	}
+	return p, nil
+}
+
+func parseProfileColumns(s string) ([]string, error) {
+	var names []string
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if !lo.Contains(allProfileColumns(), name) {
+			return nil, errors.Errorf("unknown profile column %q", name)
+		}
+		if lo.Contains(exportKeyColumns, name) {
+			return nil, errors.Errorf("column %q identifies rows and is always exported", name)
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// UserID returns the exported ID of user: a keyed hash if pseudonymisation
+// is enabled, cut to 53 bits so it stays exact in JavaScript.
+func (p *ExportPolicy) UserID(user int64) int64 {
+	if p.pseudonymKey == nil {
+		return user
+	}
+
+	mac := hmac.New(sha256.New, p.pseudonymKey)
+	mac.Write([]byte(strconv.FormatInt(user, 10)))
+	return int64(binary.BigEndian.Uint64(mac.Sum(nil)) & (1<<53 - 1))
+}
+
+// Apply returns a copy of obj as it may be exported.
+func (p *ExportPolicy) Apply(obj *UserObject) *UserObject {
+	user := p.UserID(obj.User)
+	out := &UserObject{
+		User:           user,
+		RatingRecords:  make([]*RatingRecord, 0, len(obj.RatingRecords)),
+		ProfileDetails: make([]*ProfileDetail, 0, len(obj.ProfileDetails)),
+		Version:        obj.Version,
+	}
+	for _, r := range obj.RatingRecords {
+		r := *r
+		r.User = int(user)
+		out.RatingRecords = append(out.RatingRecords, &r)
+	}
+	for _, d := range obj.ProfileDetails {
+		d := *d
+		d.User = user
+		d.omit = p.omit
+		out.ProfileDetails = append(out.ProfileDetails, &d)
+	}
+	return out
+}
+
+// marshalWithout marshals v and drops the top-level keys in omit.
+func marshalWithout(v interface{}, omit map[string]bool) ([]byte, error) {
+	b, err := json.Marshal(v)
+	if err != nil || !lo.Contains(lo.Values(omit), true) {
+		return b, err
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return nil, err
+	}
+	for name, drop := range omit {
+		if drop {
+			delete(fields, name)
+		}
+	}
+	return json.Marshal(fields)
+}
+
+// queryHiddenUsers returns the DB users of the cards in cardNums, looked up
+// in the aime_card table.
+func queryHiddenUsers(ctx context.Context, db *sql.DB, cardNums []string) (map[int64]bool, error) {
+	hidden := make(map[int64]bool)
+	if len(cardNums) == 0 {
+		return hidden, nil
+	}
+
+	query := "SELECT user FROM aime_card WHERE access_code IN (?" + strings.Repeat(", ?", len(cardNums)-1) + ")"
+	args := lo.Map(cardNums, func(cardNum string, _ int) interface{} { return cardNum })
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to query hidden users")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var user int64
+		if err := rows.Scan(&user); err != nil {
+			return nil, errors.Wrap(err, "failed to read hidden users")
+		}
+		hidden[user] = true
+	}
+	return hidden, errors.Wrap(rows.Err(), "failed to read hidden users")
+}
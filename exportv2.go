@@ -0,0 +1,153 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"log"
+)
+
+// RecordVersionV2 is the version of the v2 export format. Unlike v1, it
+// decodes the JSON columns of the DB into typed fields and is described by
+// the JSON Schema published at ratings-v2/schema.json.
+const RecordVersionV2 = 2
+
+//go:embed schema/ratings-v2.schema.json
+var ratingsV2Schema []byte
+
+type ContentV2 struct {
+	Version        int                `json:"version"`
+	Place          string             `json:"place"`
+	Game           string             `json:"game"`
+	RatingRecords  []*RatingRecordV2  `json:"ratingRecords"`
+	ProfileDetails []*ProfileDetailV2 `json:"profileDetails"`
+}
+
+type UserObjectV2 struct {
+	Version        int                `json:"version"`
+	User           int64              `json:"user"`
+	RatingRecords  []*RatingRecordV2  `json:"ratingRecords"`
+	ProfileDetails []*ProfileDetailV2 `json:"profileDetails"`
+}
+
+// RatingEntryV2 is one chart counted in a rating list.
+type RatingEntryV2 struct {
+	MusicID     int64 `json:"musicId"`
+	Level       int64 `json:"level"`
+	RomVersion  int64 `json:"romVersion"`
+	Achievement int64 `json:"achievement"`
+}
+
+// UdemaeV2 is the player's class (udemae) state.
+type UdemaeV2 struct {
+	Rate            int64 `json:"rate"`
+	MaxRate         int64 `json:"maxRate"`
+	ClassValue      int64 `json:"classValue"`
+	MaxClassValue   int64 `json:"maxClassValue"`
+	TotalWinNum     int64 `json:"totalWinNum"`
+	TotalLoseNum    int64 `json:"totalLoseNum"`
+	MaxWinNum       int64 `json:"maxWinNum"`
+	MaxLoseNum      int64 `json:"maxLoseNum"`
+	WinNum          int64 `json:"winNum"`
+	LoseNum         int64 `json:"loseNum"`
+	NpcTotalWinNum  int64 `json:"npcTotalWinNum"`
+	NpcTotalLoseNum int64 `json:"npcTotalLoseNum"`
+	NpcMaxWinNum    int64 `json:"npcMaxWinNum"`
+	NpcMaxLoseNum   int64 `json:"npcMaxLoseNum"`
+	NpcWinNum       int64 `json:"npcWinNum"`
+	NpcLoseNum      int64 `json:"npcLoseNum"`
+}
+
+type RatingRecordV2 struct {
+	ID                int64            `json:"id"`
+	User              int64            `json:"user"`
+	Version           int64            `json:"version"`
+	Rating            int64            `json:"rating"`
+	RatingList        []*RatingEntryV2 `json:"ratingList"`
+	NewRatingList     []*RatingEntryV2 `json:"newRatingList"`
+	NextRatingList    []*RatingEntryV2 `json:"nextRatingList"`
+	NextNewRatingList []*RatingEntryV2 `json:"nextNewRatingList"`
+	Udemae            *UdemaeV2        `json:"udemae"`
+}
+
+// ProfileDetailV2 is a ProfileDetail with the character slots decoded. The
+// outer fields shadow the raw ones of the embedded ProfileDetail.
+type ProfileDetailV2 struct {
+	*ProfileDetail
+	CharaSlot     []int64 `json:"charaSlot"`
+	CharaLockSlot []int64 `json:"charaLockSlot"`
+}
+
+// MarshalJSON overrides the promoted ProfileDetail.MarshalJSON, which would
+// only marshal the embedded struct.
+func (p *ProfileDetailV2) MarshalJSON() ([]byte, error) {
+	type plain ProfileDetail
+	return marshalWithout(&struct {
+		*plain
+		CharaSlot     []int64 `json:"charaSlot"`
+		CharaLockSlot []int64 `json:"charaLockSlot"`
+	}{(*plain)(p.ProfileDetail), p.CharaSlot, p.CharaLockSlot}, p.omit)
+}
+
+func NewContentV2(content *Content, place, game string) *ContentV2 {
+	return &ContentV2{
+		Version:        RecordVersionV2,
+		Place:          place,
+		Game:           game,
+		RatingRecords:  newRatingRecordsV2(content.RatingRecords),
+		ProfileDetails: newProfileDetailsV2(content.ProfileDetails),
+	}
+}
+
+func NewUserObjectV2(obj *UserObject) *UserObjectV2 {
+	return &UserObjectV2{
+		Version:        RecordVersionV2,
+		User:           obj.User,
+		RatingRecords:  newRatingRecordsV2(obj.RatingRecords),
+		ProfileDetails: newProfileDetailsV2(obj.ProfileDetails),
+	}
+}
+
+func newRatingRecordsV2(records []*RatingRecord) []*RatingRecordV2 {
+	list := make([]*RatingRecordV2, 0, len(records))
+	for _, r := range records {
+		v2 := &RatingRecordV2{
+			ID:      int64(r.ID),
+			User:    int64(r.User),
+			Version: int64(r.Version),
+			Rating:  int64(r.Rating),
+		}
+		v2.RatingList = decodeV2Field[[]*RatingEntryV2](r.RatingList, "ratingList", r.ID)
+		v2.NewRatingList = decodeV2Field[[]*RatingEntryV2](r.NewRatingList, "newRatingList", r.ID)
+		v2.NextRatingList = decodeV2Field[[]*RatingEntryV2](r.NextRatingList, "nextRatingList", r.ID)
+		v2.NextNewRatingList = decodeV2Field[[]*RatingEntryV2](r.NextNewRatingList, "nextNewRatingList", r.ID)
+		v2.Udemae = decodeV2Field[*UdemaeV2](r.Udemae, "udemae", r.ID)
+		list = append(list, v2)
+	}
+	return list
+}
+
+func newProfileDetailsV2(details []*ProfileDetail) []*ProfileDetailV2 {
+	list := make([]*ProfileDetailV2, 0, len(details))
+	for _, p := range details {
+		v2 := &ProfileDetailV2{ProfileDetail: p}
+		v2.CharaSlot = decodeV2Field[[]int64](p.CharaSlot, "charaSlot", int(p.ID))
+		v2.CharaLockSlot = decodeV2Field[[]int64](p.CharaLockSlot, "charaLockSlot", int(p.ID))
+		list = append(list, v2)
+	}
+	return list
+}
+
+// decodeV2Field decodes a JSON column. A malformed column is logged and
+// left empty rather than failing the whole export.
+func decodeV2Field[T any](raw json.RawMessage, field string, id int) T {
+	var v T
+	if len(raw) == 0 {
+		return v
+	}
+	if err := json.Unmarshal(raw, &v); err != nil {
+		log.Printf("db updater: v2: failed to decode %s of row %d: %v", field, id, err)
+		var empty T
+		return empty
+	}
+	return v
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/samber/lo"
+)
+
+// defaultGameType is the game type of cabinets that do not set one.
+const defaultGameType = "maimai"
+
+// PlayerProfile is the game-independent view of a profile row that the
+// bot's own observers work with.
+type PlayerProfile struct {
+	User     int64
+	Version  int64
+	UserName string
+	Rating   int64
+	// RatingScale is what Rating is stored times, 1 if unset.
+	RatingScale  int64
+	PlayCount    int64
+	LastPlayDate string
+	// Hidden is set for users hidden in record.txt. Their plays still count
+	// as activity, but they are not shown anywhere.
+	Hidden bool
+}
+
+// FormatRating formats v, a rating or rating difference of p's game, as the
+// game shows it.
+func (p *PlayerProfile) FormatRating(v int64) string {
+	if p.RatingScale <= 1 {
+		return strconv.FormatInt(v, 10)
+	}
+	decimals := len(strconv.FormatInt(p.RatingScale, 10)) - 1
+	return strconv.FormatFloat(float64(v)/float64(p.RatingScale), 'f', decimals, 64)
+}
+
+// visibleProfiles returns the profiles of users who are not hidden.
+func visibleProfiles(profiles []*PlayerProfile) []*PlayerProfile {
+	return lo.Reject(profiles, func(p *PlayerProfile, _ int) bool { return p.Hidden })
+}
+
+// GameUser is the rows of one user in one game's tables.
+type GameUser interface {
+	PlayerProfiles() []*PlayerProfile
+	// Export returns a copy as policy lets it out.
+	Export(policy *ExportPolicy) GameUser
+}
+
+// GameSource reads the ratings of one game type from an ARTEMiS DB.
+type GameSource struct {
+	Type string
+	// QueryMarkers returns a change marker for every user. The marker moves
+	// whenever the user's rows change.
+	QueryMarkers func(ctx context.Context, db *sql.DB) (map[int64]string, error)
+	// QueryUsers reads the rows of users. Every user gets an object, even
+	// without rows.
+	QueryUsers func(ctx context.Context, db *sql.DB, users []int64) (map[int64]GameUser, error)
+	// Formats are the export formats of the game, by name. DefaultFormat is
+	// written when none of the configured formats applies to the game.
+	Formats       map[string]*ExportFormat
+	DefaultFormat string
+	// ProfileColumns are the profile columns the export policy filters.
+	ProfileColumns []string
+}
+
+var gameSources = map[string]*GameSource{
+	"maimai": {
+		Type:           "maimai",
+		QueryMarkers:   queryUserMarkers,
+		QueryUsers:     queryMai2Users,
+		Formats:        exportFormats,
+		DefaultFormat:  "v1",
+		ProfileColumns: profileDetailColumns,
+	},
+	"chunithm": chuniSource,
+	"ongeki":   ongekiSource,
+}
+
+func gameSource(gameType string) (*GameSource, error) {
+	src, ok := gameSources[gameType]
+	if !ok {
+		types := lo.Keys(gameSources)
+		sort.Strings(types)
+		return nil, errors.Errorf("unknown game type %q, use %s", gameType, strings.Join(types, ", "))
+	}
+	return src, nil
+}
+
+// ExportFormats returns the formats of the comma-separated names that the
+// game supports, or its default format if it supports none of them.
+func (s *GameSource) ExportFormats(names string) ([]*ExportFormat, error) {
+	all, err := parseExportFormats(names)
+	if err != nil {
+		return nil, err
+	}
+
+	var formats []*ExportFormat
+	for _, f := range all {
+		if f, ok := s.Formats[f.Name]; ok {
+			formats = append(formats, f)
+		}
+	}
+	if len(formats) == 0 {
+		formats = append(formats, s.Formats[s.DefaultFormat])
+	}
+	return formats, nil
+}
+
+func queryMai2Users(ctx context.Context, db *sql.DB, users []int64) (map[int64]GameUser, error) {
+	where := "user IN (?" + strings.Repeat(", ?", len(users)-1) + ")"
+	args := lo.Map(users, func(user int64, _ int) interface{} { return user })
+
+	ratingRecords, err := queryRatingRecords(ctx, db, where, args...)
+	if err != nil {
+		return nil, err
+	}
+	profileDetails, err := queryProfileDetails(ctx, db, where, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	ratingsByUser := lo.GroupBy(ratingRecords, func(r *RatingRecord) int64 { return int64(r.User) })
+	profilesByUser := lo.GroupBy(profileDetails, func(p *ProfileDetail) int64 { return p.User })
+
+	objs := make(map[int64]GameUser, len(users))
+	for _, user := range users {
+		objs[user] = &UserObject{
+			User:           user,
+			RatingRecords:  ratingsByUser[user],
+			ProfileDetails: profilesByUser[user],
+			Version:        RecordVersion,
+		}
+	}
+	return objs, nil
+}
+
+func (o *UserObject) PlayerProfiles() []*PlayerProfile {
+	return lo.Map(o.ProfileDetails, func(p *ProfileDetail, _ int) *PlayerProfile {
+		return &PlayerProfile{
+			User:         p.User,
+			Version:      p.Version,
+			UserName:     p.UserName,
+			Rating:       p.PlayerRating,
+			PlayCount:    p.PlayCount,
+			LastPlayDate: p.LastPlayDate,
+		}
+	})
+}
+
+func (o *UserObject) Export(policy *ExportPolicy) GameUser {
+	return policy.Apply(o)
+}
+
+// mai2Content assembles the rows of users, ordered by ID like the tables.
+func mai2Content(users []GameUser) *Content {
+	content := &Content{Version: RecordVersion}
+	for _, u := range users {
+		obj := u.(*UserObject)
+		content.RatingRecords = append(content.RatingRecords, obj.RatingRecords...)
+		content.ProfileDetails = append(content.ProfileDetails, obj.ProfileDetails...)
+	}
+
+	sort.Slice(content.RatingRecords, func(a, b int) bool { return content.RatingRecords[a].ID < content.RatingRecords[b].ID })
+	sort.Slice(content.ProfileDetails, func(a, b int) bool { return content.ProfileDetails[a].ID < content.ProfileDetails[b].ID })
+	return content
+}
+
+// queryProfileMarkers returns a change marker for every user of a profile
+// table with playCount and lastPlayDate columns.
+func queryProfileMarkers(ctx context.Context, db *sql.DB, table string) (map[int64]string, error) {
+	rows, err := db.QueryContext(ctx, "SELECT user, COUNT(*), COALESCE(SUM(playCount), 0), COALESCE(MAX(lastPlayDate), '') FROM "+table+" GROUP BY user")
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to query %s markers", table)
+	}
+	defer rows.Close()
+
+	markers := make(map[int64]string)
+	for rows.Next() {
+		var user, count, playCount int64
+		var lastPlayDate string
+		if err := rows.Scan(&user, &count, &playCount, &lastPlayDate); err != nil {
+			return nil, errors.Wrapf(err, "failed to read %s markers", table)
+		}
+		markers[user] = fmt.Sprintf("p:%d/%d/%s", count, playCount, lastPlayDate)
+	}
+	return markers, errors.Wrapf(rows.Err(), "failed to read %s markers", table)
+}
+
+// RecentRating is a row of chuni_profile_recent_rating or
+// ongeki_profile_recent_rating: the charts counted in the recent part of
+// the player rating.
+type RecentRating struct {
+	ID           int64           `json:"id"`
+	User         int64           `json:"user"`
+	RecentRating json.RawMessage `json:"recentRating"`
+}
+
+func queryRecentRatings(ctx context.Context, db *sql.DB, table string, users []int64) (map[int64][]*RecentRating, error) {
+	query := "SELECT id, user, recentRating FROM " + table + " WHERE user IN (?" + strings.Repeat(", ?", len(users)-1) + ") ORDER BY id ASC"
+	rows, err := db.QueryContext(ctx, query, lo.Map(users, func(user int64, _ int) interface{} { return user })...)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to query %s", table)
+	}
+	defer rows.Close()
+
+	byUser := make(map[int64][]*RecentRating)
+	for rows.Next() {
+		var r RecentRating
+		if err := rows.Scan(&r.ID, &r.User, &r.RecentRating); err != nil {
+			return nil, errors.Wrapf(err, "failed to read %s", table)
+		}
+		byUser[r.User] = append(byUser[r.User], &r)
+	}
+	return byUser, errors.Wrapf(rows.Err(), "failed to read %s", table)
+}
+
+func (r *RecentRating) withUser(user int64) *RecentRating {
+	c := *r
+	c.User = user
+	return &c
+}
+
+// GameContent is the full export of a game without a maimai-style content
+// object: every user object, ordered by user.
+type GameContent struct {
+	Version  int        `json:"version"`
+	GameType string     `json:"gameType"`
+	Place    string     `json:"place"`
+	Game     string     `json:"game"`
+	Users    []GameUser `json:"users"`
+}
+
+// gameContentFormat is the only export format of a game type besides
+// maimai, below ratings-<type>-v1.
+func gameContentFormat(gameType string) map[string]*ExportFormat {
+	return map[string]*ExportFormat{
+		"v1": {
+			Name:    "v1",
+			Prefix:  "ratings-" + gameType + "-v1",
+			Version: RecordVersion,
+			Content: func(users []GameUser, place, game string) interface{} {
+				return &GameContent{Version: RecordVersion, GameType: gameType, Place: place, Game: game, Users: users}
+			},
+			User: func(obj GameUser) interface{} { return obj },
+		},
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/samber/lo"
+)
+
+var (
+	chuniSource = (&profileTable{
+		gameType: "chunithm",
+		table:    "chuni_profile_data",
+		recent:   "chuni_profile_recent_rating",
+		extras:   []string{"totalHiScore", "frameId"},
+	}).source()
+	ongekiSource = (&profileTable{
+		gameType: "ongeki",
+		table:    "ongeki_profile_data",
+		recent:   "ongeki_profile_recent_rating",
+		extras:   []string{"battlePoint", "cardId"},
+	}).source()
+)
+
+// profileTable reads a game that keeps its ratings in a profile table and a
+// recent rating table, like chunithm and ongeki. Their profile tables share
+// the columns of GameProfile.
+type profileTable struct {
+	gameType string
+	table    string
+	recent   string
+	// extras are the integer profile columns of only this game.
+	extras []string
+}
+
+// gameProfileColumns are the JSON names of the GameProfile fields, which
+// are also the names of their columns.
+var gameProfileColumns = jsonFieldNames(reflect.TypeOf(GameProfile{}))
+
+func (t *profileTable) source() *GameSource {
+	return &GameSource{
+		Type: t.gameType,
+		QueryMarkers: func(ctx context.Context, db *sql.DB) (map[int64]string, error) {
+			return queryProfileMarkers(ctx, db, t.table)
+		},
+		QueryUsers:     t.queryUsers,
+		Formats:        gameContentFormat(t.gameType),
+		DefaultFormat:  "v1",
+		ProfileColumns: append(append([]string(nil), gameProfileColumns...), t.extras...),
+	}
+}
+
+// profileRatingScale is what profile tables store ratings times.
+const profileRatingScale = 100
+
+// GameProfile is a row of a profile table read by profileTable. Ratings are
+// stored times profileRatingScale. The place and client columns are not read.
+type GameProfile struct {
+	ID            int64  `json:"id"`
+	User          int64  `json:"user"`
+	Version       int64  `json:"version"`
+	UserName      string `json:"userName"`
+	Level         int64  `json:"level"`
+	PlayerRating  int64  `json:"playerRating"`
+	HighestRating int64  `json:"highestRating"`
+	PlayCount     int64  `json:"playCount"`
+	TrophyID      int64  `json:"trophyId"`
+	NameplateID   int64  `json:"nameplateId"`
+	CharacterID   int64  `json:"characterId"`
+	FirstPlayDate string `json:"firstPlayDate"`
+	LastPlayDate  string `json:"lastPlayDate"`
+
+	// Extra holds the game's own columns, exported next to the others.
+	Extra map[string]int64 `json:"-"`
+
+	// omit holds the columns left out when marshalling, set by the export
+	// policy.
+	omit map[string]bool
+}
+
+func (p *GameProfile) MarshalJSON() ([]byte, error) {
+	type plain GameProfile
+	b, err := json.Marshal((*plain)(p))
+	if err != nil {
+		return nil, err
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return nil, err
+	}
+	for name, v := range p.Extra {
+		fields[name] = json.RawMessage(strconv.FormatInt(v, 10))
+	}
+	for name, drop := range p.omit {
+		if drop {
+			delete(fields, name)
+		}
+	}
+	return json.Marshal(fields)
+}
+
+// ProfileUserObject is the per-user object of a game read by profileTable.
+type ProfileUserObject struct {
+	Version       int             `json:"version"`
+	User          int64           `json:"user"`
+	Profiles      []*GameProfile  `json:"profiles"`
+	RecentRatings []*RecentRating `json:"recentRatings"`
+}
+
+func (t *profileTable) queryUsers(ctx context.Context, db *sql.DB, users []int64) (map[int64]GameUser, error) {
+	columns := append(append([]string(nil), gameProfileColumns...), t.extras...)
+	query := "SELECT " + strings.Join(columns, ", ") + " FROM " + t.table + " WHERE user IN (?" + strings.Repeat(", ?", len(users)-1) + ") ORDER BY id ASC"
+	rows, err := db.QueryContext(ctx, query, lo.Map(users, func(user int64, _ int) interface{} { return user })...)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to query %s", t.table)
+	}
+	defer rows.Close()
+
+	profiles := make(map[int64][]*GameProfile)
+	for rows.Next() {
+		var p GameProfile
+		extras := make([]int64, len(t.extras))
+		dest := []interface{}{&p.ID, &p.User, &p.Version, &p.UserName, &p.Level, &p.PlayerRating, &p.HighestRating, &p.PlayCount, &p.TrophyID, &p.NameplateID, &p.CharacterID, &p.FirstPlayDate, &p.LastPlayDate}
+		for idx := range extras {
+			dest = append(dest, &extras[idx])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, errors.Wrapf(err, "failed to read %s", t.table)
+		}
+
+		p.Extra = make(map[string]int64, len(t.extras))
+		for idx, name := range t.extras {
+			p.Extra[name] = extras[idx]
+		}
+		profiles[p.User] = append(profiles[p.User], &p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrapf(err, "failed to read %s", t.table)
+	}
+
+	recent, err := queryRecentRatings(ctx, db, t.recent, users)
+	if err != nil {
+		return nil, err
+	}
+
+	objs := make(map[int64]GameUser, len(users))
+	for _, user := range users {
+		objs[user] = &ProfileUserObject{
+			Version:       RecordVersion,
+			User:          user,
+			Profiles:      profiles[user],
+			RecentRatings: recent[user],
+		}
+	}
+	return objs, nil
+}
+
+func (o *ProfileUserObject) PlayerProfiles() []*PlayerProfile {
+	return lo.Map(o.Profiles, func(p *GameProfile, _ int) *PlayerProfile {
+		return &PlayerProfile{
+			User:         p.User,
+			Version:      p.Version,
+			UserName:     p.UserName,
+			Rating:       p.PlayerRating,
+			RatingScale:  profileRatingScale,
+			PlayCount:    p.PlayCount,
+			LastPlayDate: p.LastPlayDate,
+		}
+	})
+}
+
+func (o *ProfileUserObject) Export(policy *ExportPolicy) GameUser {
+	user := policy.UserID(o.User)
+	return &ProfileUserObject{
+		Version: o.Version,
+		User:    user,
+		Profiles: lo.Map(o.Profiles, func(p *GameProfile, _ int) *GameProfile {
+			c := *p
+			c.User = user
+			c.omit = policy.omit
+			return &c
+		}),
+		RecentRatings: lo.Map(o.RecentRatings, func(r *RecentRating, _ int) *RecentRating { return r.withUser(user) }),
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/pkg/errors"
+	"github.com/samber/lo"
+)
+
+// HistoryEntry is one line of the switch history file.
+type HistoryEntry struct {
+	Time         time.Time `json:"time"`
+	Cabinet      string    `json:"cabinet,omitempty"`
+	UserID       string    `json:"userId"`
+	Username     string    `json:"username"`
+	PrevCardNum  string    `json:"prevCardNum"`
+	PrevCardName string    `json:"prevCardName"`
+	CardNum      string    `json:"cardNum"`
+	CardName     string    `json:"cardName"`
+}
+
+// HistoryStore is an append-only JSONL log of card switches.
+type HistoryStore struct {
+	path string
+	mu   sync.Mutex
+}
+
+var history *HistoryStore
+
+func NewHistoryStore(path string) *HistoryStore {
+	return &HistoryStore{path: path}
+}
+
+func (h *HistoryStore) Append(e *HistoryEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal history entry")
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	f, err := os.OpenFile(h.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return errors.Wrap(err, "failed to open history file")
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		return errors.Wrap(err, "failed to append history entry")
+	}
+
+	return f.Sync()
+}
+
+// All returns every entry in the history file, oldest first. Lines that fail
+// to decode are skipped.
+func (h *HistoryStore) All() ([]*HistoryEntry, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	f, err := os.Open(h.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open history file")
+	}
+	defer f.Close()
+
+	var entries []*HistoryEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		var e HistoryEntry
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			log.Println("history: skipping malformed line:", err)
+			continue
+		}
+		entries = append(entries, &e)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to read history file")
+	}
+
+	return entries, nil
+}
+
+// Recent returns up to limit entries, newest first. If player is not empty,
+// only switches from or to that player's card are returned.
+func (h *HistoryStore) Recent(limit int, player string) ([]*HistoryEntry, error) {
+	entries, err := h.All()
+	if err != nil {
+		return nil, err
+	}
+
+	var recent []*HistoryEntry
+	for idx := len(entries) - 1; idx >= 0 && len(recent) < limit; idx-- {
+		e := entries[idx]
+		if player != "" && !strings.EqualFold(e.CardName, player) && !strings.EqualFold(e.PrevCardName, player) {
+			continue
+		}
+		recent = append(recent, e)
+	}
+
+	return recent, nil
+}
+
+const (
+	defaultHistoryLimit = 10
+	// maxHistoryLimit keeps a full page of entries with long names below
+	// Discord's message limit; joinLines cuts off whatever still does not fit.
+	maxHistoryLimit = 15
+)
+
+var historyCommand = &discordgo.ApplicationCommand{
+	Name:        "history",
+	Description: "Show recent AIME switches",
+	Options: []*discordgo.ApplicationCommandOption{
+		{
+			Name:        "limit",
+			Type:        discordgo.ApplicationCommandOptionInteger,
+			Description: fmt.Sprintf("Number of entries to show (default %d)", defaultHistoryLimit),
+			MinValue:    lo.ToPtr(1.0),
+			MaxValue:    maxHistoryLimit,
+		},
+		{
+			Name:         "player",
+			Type:         discordgo.ApplicationCommandOptionString,
+			Description:  "Only show switches from or to this player",
+			Autocomplete: true,
+		},
+	},
+}
+
+func (h *CommandHandlerCtx) CommandHistory(s *discordgo.Session, i *discordgo.InteractionCreate) error {
+	opts := lo.SliceToMap(i.ApplicationCommandData().Options, func(o *discordgo.ApplicationCommandInteractionDataOption) (string, *discordgo.ApplicationCommandInteractionDataOption) {
+		return o.Name, o
+	})
+
+	limit := defaultHistoryLimit
+	if opt, ok := opts["limit"]; ok {
+		limit = int(opt.IntValue())
+	}
+	player := ""
+	if opt, ok := opts["player"]; ok {
+		player = opt.StringValue()
+	}
+
+	entries, err := history.Recent(limit, player)
+	if err != nil {
+		return err
+	}
+
+	if len(entries) == 0 {
+		return respondEphemeral(s, i, "No switches recorded yet.")
+	}
+
+	lines := lo.Map(entries, func(e *HistoryEntry, _ int) string {
+		who := e.Username
+		if e.UserID != "" {
+			who = fmt.Sprintf("<@%s>", e.UserID)
+		}
+		cab := ""
+		if cabinets.Multiple() && e.Cabinet != "" {
+			cab = fmt.Sprintf("[%s] ", e.Cabinet)
+		}
+		return fmt.Sprintf("%s<t:%d:f> %s: **%s** (`%s`) → **%s** (`%s`)",
+			cab, e.Time.Unix(), who,
+			e.PrevCardName, redactedCardNum(e.PrevCardNum),
+			e.CardName, redactedCardNum(e.CardNum))
+	})
+
+	return respondMessage(s, i, &discordgo.InteractionResponseData{
+		Content:         joinLines("", lines),
+		AllowedMentions: &discordgo.MessageAllowedMentions{},
+	})
+}
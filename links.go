@@ -0,0 +1,345 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/pkg/errors"
+	"github.com/samber/lo"
+)
+
+// LinkRequest is a player's pending claim on a record.txt entry.
+type LinkRequest struct {
+	UserID      string    `json:"userId"`
+	Username    string    `json:"username"`
+	CardNum     string    `json:"cardNum"`
+	RequestedAt time.Time `json:"requestedAt"`
+}
+
+// LinkStore maps Discord user IDs to the cards they own. Links are stored
+// by card number so renaming a record.txt entry keeps its owner.
+type LinkStore struct {
+	path string
+
+	mu      sync.Mutex
+	Links   map[string][]string `json:"links"`
+	Pending []*LinkRequest      `json:"pending"`
+}
+
+var links *LinkStore
+
+// LoadLinkStore reads the links persisted at path. A missing file yields an
+// empty store.
+func LoadLinkStore(path string) (*LinkStore, error) {
+	l := &LinkStore{path: path, Links: make(map[string][]string)}
+
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read links file")
+	}
+
+	if err := json.Unmarshal(b, l); err != nil {
+		return nil, errors.Wrap(err, "failed to parse links file")
+	}
+	if l.Links == nil {
+		l.Links = make(map[string][]string)
+	}
+
+	return l, nil
+}
+
+// save persists the store. The caller must hold l.mu.
+func (l *LinkStore) save() error {
+	b, err := json.MarshalIndent(l, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal links")
+	}
+
+	return errors.Wrap(writeFileAtomic(l.path, b), "failed to write links file")
+}
+
+// CardsOf returns the card numbers linked to userID, primary card first.
+func (l *LinkStore) CardsOf(userID string) []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return append([]string(nil), l.Links[userID]...)
+}
+
+// OwnersOf returns the IDs of the users cardNum is linked to.
+func (l *LinkStore) OwnersOf(cardNum string) []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var owners []string
+	for userID, cardNums := range l.Links {
+		if lo.Contains(cardNums, cardNum) {
+			owners = append(owners, userID)
+		}
+	}
+	return owners
+}
+
+// Request records a pending claim of cardNum by the user.
+func (l *LinkStore) Request(req *LinkRequest) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if lo.Contains(l.Links[req.UserID], req.CardNum) {
+		return errors.New("this card is already linked to you")
+	}
+	if lo.ContainsBy(l.Pending, func(p *LinkRequest) bool { return p.UserID == req.UserID && p.CardNum == req.CardNum }) {
+		return errors.New("you already requested this card, waiting for an admin")
+	}
+
+	l.Pending = append(l.Pending, req)
+	if err := l.save(); err != nil {
+		l.Pending = l.Pending[:len(l.Pending)-1]
+		return err
+	}
+
+	return nil
+}
+
+// Resolve removes the pending requests of userID and, if approve is set,
+// links the requested cards. It returns the resolved requests.
+func (l *LinkStore) Resolve(userID string, approve bool) ([]*LinkRequest, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	byUser := func(p *LinkRequest, _ int) bool { return p.UserID == userID }
+	resolved, remaining := lo.Filter(l.Pending, byUser), lo.Reject(l.Pending, byUser)
+	if len(resolved) == 0 {
+		return nil, errors.New("no pending link request from this user")
+	}
+
+	prevPending, prevLinks := l.Pending, l.Links[userID]
+	l.Pending = remaining
+	if approve {
+		for _, req := range resolved {
+			if !lo.Contains(l.Links[userID], req.CardNum) {
+				l.Links[userID] = append(l.Links[userID], req.CardNum)
+			}
+		}
+	}
+
+	if err := l.save(); err != nil {
+		l.Pending, l.Links[userID] = prevPending, prevLinks
+		return nil, err
+	}
+
+	return resolved, nil
+}
+
+// Unlink removes cardNum from userID's cards.
+func (l *LinkStore) Unlink(userID, cardNum string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	prev := l.Links[userID]
+	if !lo.Contains(prev, cardNum) {
+		return errors.New("this card is not linked to the user")
+	}
+
+	l.Links[userID] = lo.Without(prev, cardNum)
+	if len(l.Links[userID]) == 0 {
+		delete(l.Links, userID)
+	}
+
+	if err := l.save(); err != nil {
+		l.Links[userID] = prev
+		return err
+	}
+
+	return nil
+}
+
+// PendingRequests returns a copy of the pending requests, oldest first.
+func (l *LinkStore) PendingRequests() []*LinkRequest {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return append([]*LinkRequest(nil), l.Pending...)
+}
+
+// resolveCardArg turns a card option value into a card number, mapping an
+// empty value or "me" to the primary card linked to userID.
+func resolveCardArg(userID, arg string) (string, error) {
+	arg = strings.TrimSpace(arg)
+	if arg != "" && !strings.EqualFold(arg, "me") {
+		return arg, nil
+	}
+
+	owned := links.CardsOf(userID)
+	if len(owned) == 0 {
+		return "", errors.New("you have no linked card, claim one with `/link request` first")
+	}
+	return owned[0], nil
+}
+
+var linkCommand = &discordgo.ApplicationCommand{
+	Name:        "link",
+	Description: "Link your Discord account to your AIME card",
+	Options: []*discordgo.ApplicationCommandOption{
+		{
+			Name:        "request",
+			Description: "Claim a registered AIME card as yours",
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Name:         "name",
+					Type:         discordgo.ApplicationCommandOptionString,
+					Description:  "Player name in record.txt",
+					Required:     true,
+					Autocomplete: true,
+				},
+			},
+		},
+		{
+			Name:        "approve",
+			Description: "Approve a user's pending link requests (admin only)",
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Name:        "user",
+					Type:        discordgo.ApplicationCommandOptionUser,
+					Description: "User who requested the link",
+					Required:    true,
+				},
+			},
+		},
+		{
+			Name:        "deny",
+			Description: "Deny a user's pending link requests (admin only)",
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Name:        "user",
+					Type:        discordgo.ApplicationCommandOptionUser,
+					Description: "User who requested the link",
+					Required:    true,
+				},
+			},
+		},
+		{
+			Name:        "unlink",
+			Description: "Remove a linked AIME card (admin only)",
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Name:        "user",
+					Type:        discordgo.ApplicationCommandOptionUser,
+					Description: "User the card is linked to",
+					Required:    true,
+				},
+				{
+					Name:         "name",
+					Type:         discordgo.ApplicationCommandOptionString,
+					Description:  "Player name in record.txt",
+					Required:     true,
+					Autocomplete: true,
+				},
+			},
+		},
+		{
+			Name:        "list",
+			Description: "Show your linked cards, or pending requests for admins",
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+		},
+	},
+}
+
+// AutocompleteLink offers the players of every cabinet, as /link resolves
+// names across cabinets.
+func (h *CommandHandlerCtx) AutocompleteLink(s *discordgo.Session, i *discordgo.InteractionCreate) error {
+	return respondAutocomplete(s, i, playerChoices(i, cabinets.Snapshot()))
+}
+
+func (h *CommandHandlerCtx) CommandLink(s *discordgo.Session, i *discordgo.InteractionCreate) error {
+	sub := i.ApplicationCommandData().Options[0]
+	opts := subCommandOptions(sub)
+	user := interactionUser(i)
+
+	if sub.Name == "approve" || sub.Name == "deny" || sub.Name == "unlink" {
+		if !h.isAdmin(i) {
+			log.Println("link: denied non-admin", user.Username)
+			return respondEphemeral(s, i, "You are not allowed to manage card links.")
+		}
+	}
+
+	switch sub.Name {
+	case "request":
+		name := opts["name"].StringValue()
+		cardNum, ok := cabinets.Lookup(name)
+		if !ok {
+			return respondEphemeral(s, i, fmt.Sprintf("Player **%s** is not registered.", name))
+		}
+
+		if err := links.Request(&LinkRequest{
+			UserID:      user.ID,
+			Username:    user.Username,
+			CardNum:     cardNum,
+			RequestedAt: time.Now(),
+		}); err != nil {
+			return errors.Wrap(err, "failed to request link")
+		}
+
+		log.Println("link:", user.Username, "requested", name)
+		return respondEphemeral(s, i, fmt.Sprintf("Requested to link **%s**. An admin needs to approve it with `/link approve`.", name))
+	case "approve", "deny":
+		target := opts["user"].UserValue(nil)
+		resolved, err := links.Resolve(target.ID, sub.Name == "approve")
+		if err != nil {
+			return errors.Wrapf(err, "failed to %s link", sub.Name)
+		}
+
+		names := lo.Map(resolved, func(req *LinkRequest, _ int) string { return cabinets.NameOf(req.CardNum) })
+		verb := lo.Ternary(sub.Name == "approve", "Approved", "Denied")
+		log.Println("link:", user.Username, strings.ToLower(verb), target.ID, names)
+		return respondEphemeral(s, i, fmt.Sprintf("%s linking <@%s> to **%s**", verb, target.ID, strings.Join(names, "**, **")))
+	case "unlink":
+		target := opts["user"].UserValue(nil)
+		name := opts["name"].StringValue()
+		cardNum, ok := cabinets.Lookup(name)
+		if !ok {
+			return respondEphemeral(s, i, fmt.Sprintf("Player **%s** is not registered.", name))
+		}
+
+		if err := links.Unlink(target.ID, cardNum); err != nil {
+			return errors.Wrap(err, "failed to unlink")
+		}
+
+		log.Println("link:", user.Username, "unlinked", name, "from", target.ID)
+		return respondEphemeral(s, i, fmt.Sprintf("Unlinked **%s** from <@%s>", name, target.ID))
+	case "list":
+		header := "You have no linked cards. Use `/link request` to claim one.\n"
+		var lines []string
+		if owned := links.CardsOf(user.ID); len(owned) > 0 {
+			header = "Your linked cards:\n"
+			lines = lo.Map(owned, func(cardNum string, _ int) string {
+				return fmt.Sprintf("- **%s** (`%s`)", cabinets.NameOf(cardNum), redactedCardNum(cardNum))
+			})
+		}
+
+		if h.isAdmin(i) {
+			pending := links.PendingRequests()
+			lines = append(lines, fmt.Sprintf("\n%d pending link requests:", len(pending)))
+			for _, req := range pending {
+				lines = append(lines, fmt.Sprintf("- <@%s> wants **%s** (<t:%d:R>)", req.UserID, cabinets.NameOf(req.CardNum), req.RequestedAt.Unix()))
+			}
+		}
+
+		return respondEphemeral(s, i, joinLines(header, lines))
+	default:
+		return respondEphemeral(s, i, "Unknown subcommand")
+	}
+}
@@ -2,14 +2,18 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
+	"github.com/GalvinGao/discord-aime-switcher/rating"
 	"github.com/bwmarrin/discordgo"
-	"github.com/gen2brain/beeep"
-	"github.com/samber/lo"
+	"github.com/pkg/errors"
 	"github.com/urfave/cli/v2"
 )
 
@@ -23,12 +27,19 @@ import (
 //         card_num, name = line.split()
 //         cards[name] = card_num
 
-func parseRecordTxt(path string) (map[string]string, error) {
+// recordTxtHidden marks a record.txt entry whose player opted out of the
+// ratings export: "<card> <name> hidden".
+const recordTxtHidden = "hidden"
+
+// parseRecordTxt returns the card number of every player and the set of
+// card numbers marked hidden.
+func parseRecordTxt(path string) (map[string]string, map[string]bool, error) {
 	cards := make(map[string]string)
+	hidden := make(map[string]bool)
 
 	f, err := os.Open(path)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	defer f.Close()
 
@@ -40,8 +51,10 @@ func parseRecordTxt(path string) (map[string]string, error) {
 		}
 
 		parts := strings.Split(line, " ")
-		if len(parts) != 2 {
-			return nil, fmt.Errorf("invalid line in record.txt: %s", line)
+		if len(parts) == 3 && parts[2] == recordTxtHidden {
+			hidden[parts[0]] = true
+		} else if len(parts) != 2 {
+			return nil, nil, fmt.Errorf("invalid line in record.txt: %s", line)
 		}
 
 		cardNum := parts[0]
@@ -51,54 +64,147 @@ func parseRecordTxt(path string) (map[string]string, error) {
 	}
 
 	if err := scanner.Err(); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	return cards, nil
+	return cards, hidden, nil
 }
 
-var cards map[string]string
+var permissions *Permissions
 
 func main() {
 	log.SetFlags(log.LstdFlags | log.Lshortfile | log.Lmicroseconds)
 	app := &cli.App{
 		Name:  "aimeswitcher",
 		Usage: "AIME Switcher",
-		Flags: []cli.Flag{
+		Flags: withEnvVars([]cli.Flag{
+			&cli.PathFlag{
+				Name:  "config",
+				Usage: "Path to a YAML or TOML config file. Keys are the flag names, plus an optional \"cabinets\" list; flags and AIMESWITCHER_* environment variables take precedence",
+			},
 			&cli.StringFlag{
-				Name:     "token",
-				Usage:    "Discord Bot Token",
-				Required: true,
+				Name:  "token",
+				Usage: "Discord Bot Token",
 			},
 			&cli.StringFlag{
-				Name:     "appid",
-				Usage:    "Discord App ID",
-				Required: true,
+				Name:  "appid",
+				Usage: "Discord App ID",
 			},
 			&cli.StringFlag{
 				Name:  "name",
-				Usage: "Game name",
+				Usage: "Game name, also used as the cabinet name when no cabinets are configured",
 				Value: "maimai",
 			},
+			&cli.StringFlag{
+				Name:  "game-type",
+				Usage: "Which game's ARTEMiS tables are exported: maimai, chunithm or ongeki",
+				Value: defaultGameType,
+			},
 			&cli.StringFlag{
 				Name:  "place",
 				Usage: "Game place",
 				Value: "RhythmROC",
 			},
 			&cli.PathFlag{
-				Name:     "aimetxt-path",
-				Usage:    "Path to the aime.txt file",
-				Required: true,
+				Name:  "aimetxt-path",
+				Usage: "Path to the aime.txt file",
+			},
+			&cli.PathFlag{
+				Name:  "recordtxt-path",
+				Usage: "Path to the record.txt file",
+			},
+			&cli.StringFlag{
+				Name:  "admin-role",
+				Usage: "Discord role ID allowed to manage cards with /card",
+			},
+			&cli.BoolFlag{
+				Name:  "require-registered-card",
+				Usage: "Refuse /switch to cards that are not in record.txt",
+			},
+			&cli.DurationFlag{
+				Name:  "recordtxt-reload-interval",
+				Usage: "How often record.txt is checked for changes",
+				Value: 5 * time.Second,
+			},
+			&cli.PathFlag{
+				Name:  "history-path",
+				Usage: "Path to the switch history file (JSON lines)",
+				Value: "switch-history.jsonl",
+			},
+			&cli.PathFlag{
+				Name:  "queue-path",
+				Usage: "Path to the file the play queue is persisted to",
+				Value: "queue.json",
+			},
+			&cli.PathFlag{
+				Name:  "links-path",
+				Usage: "Path to the file Discord user to card links are persisted to",
+				Value: "links.json",
+			},
+			&cli.PathFlag{
+				Name:  "permissions-path",
+				Usage: "Path to the JSON file with guild, channel and per-card switch permissions",
 			},
 			&cli.PathFlag{
-				Name:     "recordtxt-path",
-				Usage:    "Path to the record.txt file",
-				Required: true,
+				Name:  "chart-table-path",
+				Usage: "Path to the maimai DX chart constant table (music_data.json layout) used by /rating",
+			},
+			&cli.StringFlag{
+				Name:  "guest-card",
+				Usage: "AIME access code aime.txt is reset to when a session ends",
+			},
+			&cli.DurationFlag{
+				Name:  "session-timeout",
+				Usage: "Reset to the guest card this long after a switch (0 to disable)",
+			},
+			&cli.DurationFlag{
+				Name:  "session-idle-timeout",
+				Usage: "Reset to the guest card once the DB shows no new play for this long (0 to disable, requires --mysql-dburl)",
+			},
+			&cli.StringFlag{
+				Name:  "notify-channel",
+				Usage: "Discord channel ID to post automatic notices to",
+			},
+			&cli.StringFlag{
+				Name:  "play-announce-channel",
+				Usage: "Discord channel ID to announce finished credits to (requires --mysql-dburl)",
 			},
 			&cli.StringFlag{
 				Name:  "mysql-dburl",
 				Usage: "MySQL DB URL. Example: root:password@tcp(localhost:3306)/aime",
 			},
+			&cli.BoolFlag{
+				Name:  "export-full",
+				Usage: "Also export all ratings as the single <prefix>/<place>/<game>.json object of each format, next to the per-user delta export. Only kept while consumers move to the delta export; it will default to false and then be removed",
+				Value: true,
+			},
+			&cli.StringFlag{
+				Name:  "export-formats",
+				Usage: "Comma-separated maimai export formats to write side by side: v1 (ratings-v0/, raw JSON columns) and v2 (ratings-v2/, typed, with schema.json). Other game types have a single format, below ratings-<game-type>-v1/",
+				Value: "v1,v2",
+			},
+			&cli.StringFlag{
+				Name:  "export-datasets",
+				Usage: "Comma-separated maimai tables to export next to the ratings, each below <dataset>-v1/<place>/<game>: scores, playlogs, items, characters, maps",
+			},
+			&cli.StringFlag{
+				Name:  "export-allow-columns",
+				Usage: "Comma-separated profile columns to export, e.g. userName,playerRating; all others are left out. Columns are those of mai2_profile_detail, or of the chunithm and ongeki profile tables for those game types. Cannot be combined with --export-deny-columns",
+			},
+			&cli.StringFlag{
+				Name:  "export-deny-columns",
+				Usage: "Comma-separated profile columns left out of the export, of any game type",
+				Value: defaultExportDenyColumns,
+			},
+			&cli.StringFlag{
+				Name:  "export-pseudonym-key",
+				Usage: "When set, exported user IDs are replaced by a keyed hash of the ID. Keep the key stable to keep the pseudonyms stable",
+			},
+			&cli.StringFlag{
+				Name:  "export-backend",
+				Usage: "Where ratings are exported to: r2, s3, file or webhook",
+				Value: "r2",
+			},
 			&cli.StringFlag{
 				Name:  "r2-accountid",
 				Usage: "R2 Account ID",
@@ -115,20 +221,105 @@ func main() {
 				Name:  "r2-accountkey",
 				Usage: "R2 Account Key",
 			},
-		},
+			&cli.StringFlag{
+				Name:  "s3-endpoint",
+				Usage: "S3 endpoint URL, e.g. http://localhost:9000 for MinIO. Leave empty for AWS",
+			},
+			&cli.StringFlag{
+				Name:  "s3-region",
+				Usage: "S3 region",
+				Value: "us-east-1",
+			},
+			&cli.StringFlag{
+				Name:  "s3-bucket",
+				Usage: "S3 bucket",
+			},
+			&cli.StringFlag{
+				Name:  "s3-accesskeyid",
+				Usage: "S3 access key ID",
+			},
+			&cli.StringFlag{
+				Name:  "s3-secretaccesskey",
+				Usage: "S3 secret access key",
+			},
+			&cli.BoolFlag{
+				Name:  "s3-path-style",
+				Usage: "Use path-style S3 addressing (needed for MinIO)",
+			},
+			&cli.PathFlag{
+				Name:  "export-dir",
+				Usage: "Directory ratings are exported to with --export-backend=file",
+			},
+			&cli.StringFlag{
+				Name:  "webhook-url",
+				Usage: "Base URL ratings are sent to with --export-backend=webhook; the object key is appended",
+			},
+			&cli.StringFlag{
+				Name:  "webhook-method",
+				Usage: "HTTP method used for the webhook: PUT or POST",
+				Value: "PUT",
+			},
+			&cli.StringFlag{
+				Name:  "webhook-token",
+				Usage: "Bearer token sent with webhook requests",
+			},
+			&cli.StringFlag{
+				Name:  "api-listen",
+				Usage: "Address to serve the HTTP/JSON control API and web dashboard on, e.g. 127.0.0.1:8080 (disabled when empty)",
+			},
+			&cli.StringFlag{
+				Name:  "api-token",
+				Usage: "Bearer token required by the HTTP/JSON control API",
+			},
+			&cli.StringFlag{
+				Name:  "agent-listen",
+				Usage: "Address the server accepts agent connections on, e.g. :8765",
+			},
+			&cli.StringFlag{
+				Name:  "agent-token",
+				Usage: "Shared secret agents authenticate to the server with",
+			},
+			&cli.StringFlag{
+				Name:  "agent-name",
+				Usage: "Agent name. In agent mode, the name reported to the server; on the server without cabinets, the agent that owns aime.txt",
+			},
+			&cli.StringFlag{
+				Name:  "server-url",
+				Usage: "WebSocket URL of the server in agent mode, e.g. ws://bot.example.com:8765/agent",
+			},
+		}),
+		Before: LoadConfig,
 		Action: Start,
+		Commands: []*cli.Command{
+			{
+				Name:   "server",
+				Usage:  "Run the Discord bot (the default when no command is given)",
+				Action: Start,
+			},
+			{
+				Name:      "agent",
+				Usage:     "Run on a cab PC and write aime.txt on behalf of a server",
+				UsageText: "aimeswitcher --server-url URL --agent-token TOKEN --agent-name NAME --aimetxt-path PATH agent",
+				Action:    RunAgent,
+			},
+		},
 	}
 
-	if err := app.Run(os.Args); err != nil {
-		log.Println(err)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := app.RunContext(ctx, os.Args); err != nil {
+		log.Println("Program has exited with error:", err)
+		stop()
+		os.Exit(1)
 	}
 
-	log.Println("Program has exited. Waiting for signal...")
-	<-make(chan struct{})
+	log.Println("Program has exited")
 }
 
 type CommandHandlerCtx struct {
-	c *cli.Context
+	c   *cli.Context
+	svc *CardService
 }
 
 func redactedCardNum(cardNum string) string {
@@ -139,177 +330,375 @@ func redactedCardNum(cardNum string) string {
 	return fmt.Sprintf("*%s", cardNum[len(cardNum)-4:])
 }
 
+// interactionUser returns the user who triggered i, for both guild and DM
+// interactions.
+func interactionUser(i *discordgo.InteractionCreate) *discordgo.User {
+	if i.Member != nil {
+		return i.Member.User
+	}
+	return i.User
+}
+
+// allowCard checks the card policy on cab for the invoking user. Admins may
+// switch to any card. Denials are logged.
+func (h *CommandHandlerCtx) allowCard(i *discordgo.InteractionCreate, cab *Cabinet, cardNum string) error {
+	if h.isAdmin(i) {
+		return nil
+	}
+
+	user := interactionUser(i)
+	if err := permissions.AllowCard(cab.Cards, user.ID, cardNum); err != nil {
+		log.Println("permission: denied card", redactedCardNum(cardNum), "to", user.Username, user.ID, ":", err)
+		return err
+	}
+	return nil
+}
+
 func Start(c *cli.Context) error {
-	if c.String("mysql-dburl") != "" {
-		StartDBUpdater(c)
+	ctx, cancel := context.WithCancel(c.Context)
+	defer cancel()
+
+	var hub *AgentHub
+	if addr := c.String("agent-listen"); addr != "" {
+		hub = NewAgentHub(c.String("agent-token"))
+		if err := hub.Start(ctx, addr); err != nil {
+			return err
+		}
+	}
+
+	var err error
+	cabinets, err = LoadCabinets(ctx, c, cabinetConfigs(c), hub)
+	if err != nil {
+		return err
 	}
 
-	recordtxtPath := c.String("recordtxt-path")
+	history = NewHistoryStore(c.Path("history-path"))
+	entries, err := history.All()
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		recentSwitches.Touch(e.CardNum, e.Time)
+	}
 
-	records, err := parseRecordTxt(recordtxtPath)
+	queue, err = LoadPlayQueue(c.Path("queue-path"))
 	if err != nil {
 		return err
 	}
-	cards = records
 
-	dg, err := discordgo.New("Bot " + c.String("token"))
+	links, err = LoadLinkStore(c.Path("links-path"))
 	if err != nil {
 		return err
 	}
 
-	if err := dg.Open(); err != nil {
+	permissions, err = LoadPermissions(c.Path("permissions-path"))
+	if err != nil {
+		return err
+	}
+
+	if path := c.Path("chart-table-path"); path != "" {
+		if chartTable, err = rating.LoadChartTable(path); err != nil {
+			return err
+		}
+		log.Println("rating: loaded constants of", chartTable.Len(), "musics")
+	}
+
+	svc := NewCardService(c.Bool("require-registered-card"))
+
+	var dashboard *Dashboard
+	if c.String("api-listen") != "" {
+		dashboard = NewDashboard(svc)
+		queue.OnChange(dashboard.Notify)
+	}
+
+	// The session is only connected at the end, so nothing below depends on
+	// Discord being reachable.
+	dg, err := discordgo.New("Bot " + c.String("token"))
+	if err != nil {
 		return err
 	}
 
-	// add presence
+	target := c.String("name")
+	if cabinets.Multiple() {
+		target = "a cabinet"
+	}
 
 	commands := []*discordgo.ApplicationCommand{
 		{
 			Name:        "switch",
-			Description: fmt.Sprintf("Switch active AIME of %s", c.String("name")),
+			Description: fmt.Sprintf("Switch active AIME of %s", target),
 			Options: []*discordgo.ApplicationCommandOption{
 				{
 					Name:         "card",
 					Autocomplete: true,
 					Type:         discordgo.ApplicationCommandOptionString,
-					Description:  "AIME card",
-					Required:     true,
+					Description:  "AIME card, or \"me\" (the default) for your linked card",
 				},
+				cabinetOption(),
 			},
 		},
 		{
 			Name:        "whoami",
-			Description: fmt.Sprintf("Get current active AIME of %s", c.String("name")),
+			Description: fmt.Sprintf("Get current active AIME of %s", target),
+			Options: []*discordgo.ApplicationCommandOption{
+				cabinetOption(),
+			},
 		},
+		cardCommand,
+		historyCommand,
+		queueCommand,
+		linkCommand,
+		ratingCommand,
 	}
 
-	if _, err = dg.ApplicationCommandBulkOverwrite(c.String("appid"), "", commands); err != nil {
-		return err
+	hCtx := &CommandHandlerCtx{c: c, svc: svc}
+
+	var updaters []*DBUpdater
+	for _, cab := range cabinets.All() {
+		cab.Sessions, err = NewSessionManager(hCtx, dg, cab)
+		if err != nil {
+			return err
+		}
+
+		var observers []ProfileObserver
+		if cab.Sessions != nil {
+			if cardNum, err := cab.Aime.Read(ctx); err == nil {
+				cab.Sessions.Begin(cardNum, time.Now())
+			}
+			cab.Sessions.Start(ctx)
+			observers = append(observers, cab.Sessions.ObserveProfiles)
+		}
+
+		if channelID := c.String("play-announce-channel"); channelID != "" {
+			observers = append(observers, NewPlayDetector(dg, channelID, cab.Game).ObserveProfiles)
+		}
+
+		if dashboard != nil {
+			observers = append(observers, dashboard.Observer(cab))
+		}
+
+		if cab.MySqlDBURL != "" {
+			dbu, err := StartDBUpdater(ctx, c, cab, observers...)
+			if err != nil {
+				return err
+			}
+			cab.Updater = dbu
+			updaters = append(updaters, dbu)
+		}
+	}
+
+	// dbuStopped collects the result of every DB updater, so one failing
+	// stops the bot and shutdown waits for the others' final flush.
+	dbuStopped := make(chan error, len(updaters))
+	for _, dbu := range updaters {
+		go func(dbu *DBUpdater) {
+			dbuStopped <- <-dbu.Done()
+		}(dbu)
 	}
+	pending := len(updaters)
 
-	hCtx := &CommandHandlerCtx{c: c}
+	// The API and dashboard start before Discord is connected so they keep
+	// working when Discord does not.
+	if addr := c.String("api-listen"); addr != "" {
+		if err := NewAPIServer(c.String("api-token"), svc, dashboard).Start(ctx, addr); err != nil {
+			return err
+		}
+	}
+
+	handlers := map[string]CommandHandler{
+		"switch":  hCtx.CommandSwitch,
+		"whoami":  hCtx.CommandWhoami,
+		"card":    hCtx.CommandCard,
+		"history": hCtx.CommandHistory,
+		"queue":   hCtx.CommandQueue,
+		"link":    hCtx.CommandLink,
+		"rating":  hCtx.CommandRating,
+	}
 
-	handlers := map[string]func(s *discordgo.Session, i *discordgo.InteractionCreate){
-		"switch": hCtx.CommandSwitch,
-		"whoami": hCtx.CommandWhoami,
+	autocompleteHandlers := map[string]CommandHandler{
+		"switch":  hCtx.AutocompleteSwitch,
+		"queue":   hCtx.AutocompleteSwitch,
+		"card":    hCtx.AutocompleteCard,
+		"history": hCtx.AutocompleteCard,
+		"link":    hCtx.AutocompleteLink,
+		"rating":  hCtx.AutocompleteRating,
 	}
 
 	dg.AddHandler(func(s *discordgo.Session, i *discordgo.InteractionCreate) {
-		defer func() {
-			if err := recover(); err != nil {
-				log.Println("recovered from panic:", err)
-			}
-		}()
+		if i.Type != discordgo.InteractionApplicationCommand && i.Type != discordgo.InteractionApplicationCommandAutocomplete {
+			return
+		}
 
 		name := i.ApplicationCommandData().Name
-		if i.Type == discordgo.InteractionApplicationCommandAutocomplete {
-			switch name {
-			case "switch":
-				choices := make([]*discordgo.ApplicationCommandOptionChoice, 0, len(cards))
-				for name, cardNum := range cards {
-					choices = append(choices, &discordgo.ApplicationCommandOptionChoice{
-						Name:  fmt.Sprintf("%s (%s)", name, redactedCardNum(cardNum)),
-						Value: cardNum,
-					})
+		if err := permissions.AllowInteraction(i); err != nil {
+			log.Println("permission: denied", name, "from", interactionUser(i).Username, "in guild", i.GuildID, "channel", i.ChannelID, ":", err)
+			if i.Type == discordgo.InteractionApplicationCommand {
+				if err := respondEphemeral(s, i, fmt.Sprintf("Denied: %v", err)); err != nil {
+					log.Println("permission: failed to respond:", err)
 				}
-
-				log.Println("autocomplete: responding with choices", choices)
-
-				lo.Must0(s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
-					Type: discordgo.InteractionApplicationCommandAutocompleteResult,
-					Data: &discordgo.InteractionResponseData{
-						Choices: choices,
-					},
-				}))
-			default:
-				lo.Must0(s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
-					Type: discordgo.InteractionResponseChannelMessageWithSource,
-					Data: &discordgo.InteractionResponseData{
-						Content: "Unknown autocomplete command",
-					},
-				}))
 			}
+			return
+		}
+
+		table := handlers
+		if i.Type == discordgo.InteractionApplicationCommandAutocomplete {
+			table = autocompleteHandlers
 		} else {
-			log.Println("command: got command", name, "from", i.Member.User.Username)
-			if handler, ok := handlers[name]; ok {
-				handler(s, i)
-			} else {
-				lo.Must0(s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
-					Type: discordgo.InteractionResponseChannelMessageWithSource,
-					Data: &discordgo.InteractionResponseData{
-						Content: "Unknown command",
-					},
-				}))
+			log.Println("command: got command", name, "from", interactionUser(i).Username)
+		}
+
+		handler, ok := table[name]
+		if !ok {
+			handler = func(s *discordgo.Session, i *discordgo.InteractionCreate) error {
+				return errors.Errorf("unknown %s %q", interactionKind(i), name)
 			}
 		}
+
+		runHandler(name, handler, s, i)
 	})
 
-	log.Println("Bot is running!")
-	<-make(chan struct{})
+	connected := make(chan struct{})
+	go func() {
+		defer close(connected)
+		connectDiscord(ctx, dg, c.String("appid"), commands)
+	}()
+
+	var runErr error
+	select {
+	case <-ctx.Done():
+		log.Println("Shutting down:", context.Cause(ctx))
+	case runErr = <-dbuStopped:
+		runErr = errors.Wrap(runErr, "db updater stopped")
+		pending--
+	}
+	cancel()
 
-	return nil
-}
+	<-connected
+	if err := dg.Close(); err != nil {
+		log.Println("failed to close discord session:", err)
+	}
 
-func (h *CommandHandlerCtx) CommandSwitch(s *discordgo.Session, i *discordgo.InteractionCreate) {
-	// write to aime.txt
-	cardNum := i.ApplicationCommandData().Options[0].StringValue()
-	if err := os.WriteFile(h.c.String("aimetxt-path"), []byte(cardNum), 0o644); err != nil {
-		lo.Must0(s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
-			Type: discordgo.InteractionResponseChannelMessageWithSource,
-			Data: &discordgo.InteractionResponseData{
-				Content: fmt.Sprintf("Failed to write to aime.txt: %v", err),
-			},
-		}))
+	for ; pending > 0; pending-- {
+		if err := <-dbuStopped; err != nil {
+			log.Println("db updater: last export failed:", err)
+		}
 	}
 
-	cardName := "(unknown)"
-	for name, num := range cards {
-		if num == string(cardNum) {
-			cardName = name
-			break
+	return runErr
+}
+
+// discordRetryInterval is how long to wait before connecting to Discord again
+// after a failed attempt.
+const discordRetryInterval = 30 * time.Second
+
+// connectDiscord opens dg and registers commands, retrying until it succeeds
+// or ctx is done. Once open, dg reconnects by itself.
+func connectDiscord(ctx context.Context, dg *discordgo.Session, appID string, commands []*discordgo.ApplicationCommand) {
+	for {
+		err := dg.Open()
+		if err == nil {
+			if _, err = dg.ApplicationCommandBulkOverwrite(appID, "", commands); err == nil {
+				log.Println("Bot is running!")
+				return
+			}
+			err = errors.Wrap(err, "failed to register commands")
+			if closeErr := dg.Close(); closeErr != nil {
+				log.Println("discord: failed to close session:", closeErr)
+			}
+		}
+		log.Println("discord: failed to connect, retrying in", discordRetryInterval, ":", err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(discordRetryInterval):
 		}
 	}
+}
+
+func (h *CommandHandlerCtx) CommandSwitch(s *discordgo.Session, i *discordgo.InteractionCreate) error {
+	cab, err := cabinetFor(i)
+	if err != nil {
+		return respondEphemeral(s, i, fmt.Sprintf("Cannot switch: %v", err))
+	}
 
-	message := fmt.Sprintf("Switched active AIME on **%s** to **%s** (`%s`)", h.c.String("name"), cardName, cardNum)
+	arg := ""
+	if opt := findOption(i.ApplicationCommandData().Options, "card"); opt != nil {
+		arg = opt.StringValue()
+	}
+
+	cardNum, err := resolveCardArg(interactionUser(i).ID, arg)
+	if err != nil {
+		return respondEphemeral(s, i, fmt.Sprintf("Cannot switch: %v", err))
+	}
 
-	log.Println(message)
+	if err := h.svc.Validate(cab, cardNum); err != nil {
+		log.Println("switch: refused invalid card", cardNum, "from", interactionUser(i).Username, ":", err)
+		return respondEphemeral(s, i, fmt.Sprintf("Refusing to switch to `%s`: %v", cardNum, err))
+	}
 
-	lo.Must0(s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
-		Type: discordgo.InteractionResponseChannelMessageWithSource,
-		Data: &discordgo.InteractionResponseData{
-			Content: message,
-		},
-	}))
+	if err := h.allowCard(i, cab, cardNum); err != nil {
+		return respondEphemeral(s, i, fmt.Sprintf("Refusing to switch to `%s`: %v", redactedCardNum(cardNum), err))
+	}
+
+	if err := deferForCabinet(s, i, cab); err != nil {
+		return err
+	}
+
+	cardName, err := h.svc.Switch(context.Background(), cab, interactionUser(i), cardNum)
+	if err != nil {
+		return err
+	}
 
-	lo.Must0(beeep.Notify(fmt.Sprintf("%s AIME Switched", h.c.String("name")), message, ""))
+	return respondText(s, i, fmt.Sprintf("Switched active AIME on **%s** to **%s** (`%s`)", cab.Name, cardName, cardNum))
 }
 
-func (h *CommandHandlerCtx) CommandWhoami(s *discordgo.Session, i *discordgo.InteractionCreate) {
-	// read from aime.txt
-	cardNum, err := os.ReadFile(h.c.String("aimetxt-path"))
+func (h *CommandHandlerCtx) AutocompleteSwitch(s *discordgo.Session, i *discordgo.InteractionCreate) error {
+	if ok, err := autocompleteCabinet(s, i); ok {
+		return err
+	}
+
+	cab, err := cabinetFor(i)
 	if err != nil {
-		lo.Must0(s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
-			Type: discordgo.InteractionResponseChannelMessageWithSource,
-			Data: &discordgo.InteractionResponseData{
-				Content: fmt.Sprintf("Failed to read from aime.txt: %v", err),
-			},
-		}))
+		return err
+	}
+
+	choices := switchAutocompleteChoices(i, cab.Cards)
+
+	log.Println("autocomplete: responding with", len(choices), "choices")
+
+	return respondAutocomplete(s, i, choices)
+}
+
+func (h *CommandHandlerCtx) CommandWhoami(s *discordgo.Session, i *discordgo.InteractionCreate) error {
+	cab, err := cabinetFor(i)
+	if err != nil {
+		return respondEphemeral(s, i, err.Error())
+	}
+
+	if err := deferForCabinet(s, i, cab); err != nil {
+		return err
 	}
 
-	cardName := "(unknown)"
-	for name, num := range cards {
-		if num == string(cardNum) {
-			cardName = name
-			break
+	status := cab.AgentStatus()
+	cardNum, cardName, err := h.svc.Current(context.Background(), cab)
+	if err != nil {
+		if status != nil && status.Problem() != "" {
+			return respondEphemeral(s, i, fmt.Sprintf("Cannot read the active AIME on **%s**: %s", cab.Name, status.Problem()))
 		}
+		return err
 	}
 
-	log.Println("whoami: responding with", cardName, cardNum)
+	log.Println("whoami: responding with", cab.Name, cardName, cardNum)
 
-	lo.Must0(s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
-		Type: discordgo.InteractionResponseChannelMessageWithSource,
-		Data: &discordgo.InteractionResponseData{
-			Content: fmt.Sprintf("Active AIME on **%s** is **%s** (`%s`)", h.c.String("name"), cardName, cardNum),
-		},
-	}))
+	message := fmt.Sprintf("Active AIME on **%s** is **%s** (`%s`)", cab.Name, cardName, cardNum)
+	if status != nil {
+		if problem := status.Problem(); problem != "" {
+			message += fmt.Sprintf("\n⚠️ %s", problem)
+		} else {
+			message += fmt.Sprintf("\nAgent **%s** last reported in <t:%d:R>", status.Agent, status.LastSeen.Unix())
+		}
+	}
+
+	return respondText(s, i, message)
 }
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/pkg/errors"
+	"github.com/samber/lo"
+)
+
+// CardPolicyMode decides who may switch to a card.
+type CardPolicyMode string
+
+const (
+	// CardPolicyAnyone lets every user switch to the card.
+	CardPolicyAnyone CardPolicyMode = "anyone"
+	// CardPolicyOwner only lets users linked to the card switch to it.
+	CardPolicyOwner CardPolicyMode = "owner"
+	// CardPolicyAllowlist lets the linked users and the users in Allow
+	// switch to the card.
+	CardPolicyAllowlist CardPolicyMode = "allowlist"
+)
+
+type CardPolicy struct {
+	Mode  CardPolicyMode `json:"mode"`
+	Allow []string       `json:"allow"`
+}
+
+// Permissions is the access policy loaded from the permissions file.
+//
+// Example:
+//
+//	{
+//	  "guilds": ["123456789012345678"],
+//	  "channels": [],
+//	  "defaultPolicy": "owner",
+//	  "cards": {
+//	    "alice": {"mode": "allowlist", "allow": ["234567890123456789"]},
+//	    "guest": {"mode": "anyone"}
+//	  }
+//	}
+type Permissions struct {
+	// Guilds and Channels restrict where commands are accepted. An empty
+	// list allows all.
+	Guilds   []string `json:"guilds"`
+	Channels []string `json:"channels"`
+
+	// DefaultPolicy applies to cards without an entry in Cards.
+	DefaultPolicy CardPolicyMode `json:"defaultPolicy"`
+	// Cards holds per-card policies keyed by player name in record.txt.
+	Cards map[string]*CardPolicy `json:"cards"`
+}
+
+var (
+	ErrGuildNotAllowed   = errors.New("this bot is not enabled in this server")
+	ErrChannelNotAllowed = errors.New("this bot is not enabled in this channel")
+	ErrCardNotAllowed    = errors.New("you are not allowed to switch to this card")
+)
+
+// LoadPermissions reads the permissions file at path. An empty path yields
+// a policy that allows everything, matching the behaviour before
+// permissions existed.
+func LoadPermissions(path string) (*Permissions, error) {
+	p := &Permissions{DefaultPolicy: CardPolicyAnyone}
+	if path == "" {
+		return p, nil
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read permissions file")
+	}
+
+	if err := json.Unmarshal(b, p); err != nil {
+		return nil, errors.Wrap(err, "failed to parse permissions file")
+	}
+
+	for name, policy := range p.Cards {
+		if err := policy.Mode.validate(); err != nil {
+			return nil, errors.Wrapf(err, "invalid policy for card %s", name)
+		}
+	}
+	if err := p.DefaultPolicy.validate(); err != nil {
+		return nil, errors.Wrap(err, "invalid default policy")
+	}
+
+	return p, nil
+}
+
+func (m CardPolicyMode) validate() error {
+	switch m {
+	case CardPolicyAnyone, CardPolicyOwner, CardPolicyAllowlist:
+		return nil
+	}
+	return errors.Errorf("unknown policy mode %q", m)
+}
+
+// AllowInteraction checks the guild and channel allowlists.
+func (p *Permissions) AllowInteraction(i *discordgo.InteractionCreate) error {
+	if len(p.Guilds) > 0 && !lo.Contains(p.Guilds, i.GuildID) {
+		return ErrGuildNotAllowed
+	}
+	if len(p.Channels) > 0 && !lo.Contains(p.Channels, i.ChannelID) {
+		return ErrChannelNotAllowed
+	}
+	return nil
+}
+
+// AllowCard checks whether userID may switch to cardNum under the card's
+// policy. Policies are looked up by the card's name in registry; cards that
+// are not registered fall under the default policy and have no owners.
+func (p *Permissions) AllowCard(registry *CardRegistry, userID, cardNum string) error {
+	policy := &CardPolicy{Mode: p.DefaultPolicy}
+	if name, ok := registry.NameByCard(cardNum); ok {
+		if cp, ok := p.Cards[name]; ok {
+			policy = cp
+		}
+	}
+
+	switch policy.Mode {
+	case CardPolicyAnyone:
+		return nil
+	case CardPolicyAllowlist:
+		if lo.Contains(policy.Allow, userID) {
+			return nil
+		}
+	}
+
+	if lo.Contains(links.OwnersOf(cardNum), userID) {
+		return nil
+	}
+
+	return ErrCardNotAllowed
+}
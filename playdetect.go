@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+type profileKey struct {
+	User    int64
+	Version int64
+}
+
+// PlayDetector diffs successive profile snapshots and announces finished
+// credits to a Discord channel.
+type PlayDetector struct {
+	dg        *discordgo.Session
+	channelID string
+	game      string
+
+	mu   sync.Mutex
+	prev map[profileKey]*PlayerProfile
+}
+
+func NewPlayDetector(dg *discordgo.Session, channelID, game string) *PlayDetector {
+	return &PlayDetector{
+		dg:        dg,
+		channelID: channelID,
+		game:      game,
+	}
+}
+
+// PlayResult is a credit detected between two snapshots of one profile.
+type PlayResult struct {
+	Before *PlayerProfile
+	After  *PlayerProfile
+}
+
+func (r *PlayResult) RatingDelta() int64 {
+	return r.After.Rating - r.Before.Rating
+}
+
+// diffProfiles returns the profiles whose play count increased between prev
+// and next.
+func diffProfiles(prev map[profileKey]*PlayerProfile, next []*PlayerProfile) []*PlayResult {
+	var results []*PlayResult
+	for _, p := range next {
+		before, ok := prev[profileKey{User: p.User, Version: p.Version}]
+		if !ok {
+			continue
+		}
+		if p.PlayCount > before.PlayCount || (p.PlayCount == before.PlayCount && p.LastPlayDate != before.LastPlayDate) {
+			results = append(results, &PlayResult{Before: before, After: p})
+		}
+	}
+	return results
+}
+
+// ObserveProfiles is a ProfileObserver. The first snapshot only primes the
+// detector so a restart does not announce old plays. Hidden users are never
+// announced.
+func (d *PlayDetector) ObserveProfiles(profiles []*PlayerProfile) {
+	profiles = visibleProfiles(profiles)
+	next := make(map[profileKey]*PlayerProfile, len(profiles))
+	for _, p := range profiles {
+		next[profileKey{User: p.User, Version: p.Version}] = p
+	}
+
+	d.mu.Lock()
+	prev := d.prev
+	d.prev = next
+	d.mu.Unlock()
+
+	if prev == nil {
+		return
+	}
+
+	for _, result := range diffProfiles(prev, profiles) {
+		d.announce(result)
+	}
+}
+
+func (d *PlayDetector) announce(r *PlayResult) {
+	delta := r.RatingDelta()
+	rating, change := r.After.FormatRating(r.After.Rating), r.After.FormatRating(delta)
+	if delta >= 0 {
+		change = "+" + change
+	}
+	log.Println("play detected:", r.After.UserName, "rating", rating, "delta", change, "play count", r.After.PlayCount)
+
+	color := 0x95a5a6
+	switch {
+	case delta > 0:
+		color = 0x2ecc71
+	case delta < 0:
+		color = 0xe74c3c
+	}
+
+	embed := &discordgo.MessageEmbed{
+		Title:       fmt.Sprintf("%s finished a credit", r.After.UserName),
+		Description: fmt.Sprintf("Played on **%s**", d.game),
+		Color:       color,
+		Fields: []*discordgo.MessageEmbedField{
+			{
+				Name:   "Rating",
+				Value:  fmt.Sprintf("%s (%s)", rating, change),
+				Inline: true,
+			},
+			{
+				Name:   "Play Count",
+				Value:  fmt.Sprintf("%d (+%d)", r.After.PlayCount, r.After.PlayCount-r.Before.PlayCount),
+				Inline: true,
+			},
+		},
+		Footer: &discordgo.MessageEmbedFooter{
+			Text: fmt.Sprintf("Last played %s", r.After.LastPlayDate),
+		},
+	}
+
+	if _, err := d.dg.ChannelMessageSendEmbed(d.channelID, embed); err != nil {
+		log.Println("play detected: failed to post announcement:", err)
+	}
+}
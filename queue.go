@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/pkg/errors"
+	"github.com/samber/lo"
+)
+
+// QueueEntry is a player waiting for their turn on the cab.
+type QueueEntry struct {
+	UserID   string    `json:"userId"`
+	Username string    `json:"username"`
+	Cabinet  string    `json:"cabinet,omitempty"`
+	CardNum  string    `json:"cardNum"`
+	JoinedAt time.Time `json:"joinedAt"`
+}
+
+// cabinet returns the cabinet e queued for. Entries persisted before
+// cabinets existed, or for a cabinet that was since removed, fall back to
+// the first cabinet.
+func (e *QueueEntry) cabinet() *Cabinet {
+	if cab, ok := cabinets.Get(e.Cabinet); ok {
+		return cab
+	}
+	return cabinets.Default("")
+}
+
+// PlayQueue holds a first-come first-served queue of players per cabinet.
+// Every mutation is persisted to a JSON file so the queue survives restarts.
+type PlayQueue struct {
+	path string
+
+	mu       sync.Mutex
+	entries  []*QueueEntry
+	onChange func()
+}
+
+var queue *PlayQueue
+
+// LoadPlayQueue reads the queue persisted at path. A missing file yields an
+// empty queue.
+func LoadPlayQueue(path string) (*PlayQueue, error) {
+	q := &PlayQueue{path: path}
+
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return q, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read queue file")
+	}
+
+	if err := json.Unmarshal(b, &q.entries); err != nil {
+		return nil, errors.Wrap(err, "failed to parse queue file")
+	}
+
+	return q, nil
+}
+
+// OnChange registers fn to be called after every change of the queue.
+func (q *PlayQueue) OnChange(fn func()) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.onChange = fn
+}
+
+// save persists the queue and reports the change. The caller must hold q.mu.
+func (q *PlayQueue) save() error {
+	b, err := json.MarshalIndent(q.entries, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal queue")
+	}
+
+	if err := writeFileAtomic(q.path, b); err != nil {
+		return errors.Wrap(err, "failed to write queue file")
+	}
+
+	if q.onChange != nil {
+		q.onChange()
+	}
+	return nil
+}
+
+// Join appends e to the queue of its cabinet and returns its 1-based
+// position there. A user can wait for several cabinets at once, but only
+// once for each.
+func (q *PlayQueue) Join(e *QueueEntry) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	cab := e.cabinet()
+	if _, idx, ok := lo.FindIndexOf(q.listLocked(cab), func(x *QueueEntry) bool { return x.UserID == e.UserID }); ok {
+		return idx + 1, errors.Errorf("you are already in the queue of %s at position %d", cab.Name, idx+1)
+	}
+
+	q.entries = append(q.entries, e)
+	if err := q.save(); err != nil {
+		q.entries = q.entries[:len(q.entries)-1]
+		return 0, err
+	}
+
+	return len(q.listLocked(cab)), nil
+}
+
+// Leave removes userID from the queue of cab. It reports whether the user
+// was queued there.
+func (q *PlayQueue) Leave(userID string, cab *Cabinet) (bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	remaining := lo.Reject(q.entries, func(x *QueueEntry, _ int) bool { return x.UserID == userID && x.cabinet() == cab })
+	if len(remaining) == len(q.entries) {
+		return false, nil
+	}
+
+	prev := q.entries
+	q.entries = remaining
+	if err := q.save(); err != nil {
+		q.entries = prev
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Advance calls fn with the head of cab's queue and removes the head once fn
+// succeeds, so a failed switch keeps the player at the front. It returns
+// nil if nobody waits for cab.
+func (q *PlayQueue) Advance(cab *Cabinet, fn func(head *QueueEntry) error) (*QueueEntry, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	head, idx, ok := lo.FindIndexOf(q.entries, func(x *QueueEntry) bool { return x.cabinet() == cab })
+	if !ok {
+		return nil, nil
+	}
+
+	if err := fn(head); err != nil {
+		return nil, err
+	}
+
+	q.entries = append(q.entries[:idx:idx], q.entries[idx+1:]...)
+	if err := q.save(); err != nil {
+		log.Println("queue: failed to persist after advancing:", err)
+	}
+
+	return head, nil
+}
+
+// List returns a copy of the queue in order, of every cabinet.
+func (q *PlayQueue) List() []*QueueEntry {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return append([]*QueueEntry(nil), q.entries...)
+}
+
+// ListFor returns the queue of cab in order.
+func (q *PlayQueue) ListFor(cab *Cabinet) []*QueueEntry {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.listLocked(cab)
+}
+
+func (q *PlayQueue) listLocked(cab *Cabinet) []*QueueEntry {
+	return lo.Filter(q.entries, func(x *QueueEntry, _ int) bool { return x.cabinet() == cab })
+}
+
+var queueCommand = &discordgo.ApplicationCommand{
+	Name:        "queue",
+	Description: "Wait in line for the cab",
+	Options: []*discordgo.ApplicationCommandOption{
+		{
+			Name:        "join",
+			Description: "Join the play queue",
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Name:         "card",
+					Type:         discordgo.ApplicationCommandOptionString,
+					Description:  "AIME card to switch to on your turn",
+					Required:     true,
+					Autocomplete: true,
+				},
+				cabinetOption(),
+			},
+		},
+		{
+			Name:        "leave",
+			Description: "Leave the play queue",
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Options: []*discordgo.ApplicationCommandOption{
+				cabinetOption(),
+			},
+		},
+		{
+			Name:        "list",
+			Description: "Show the play queue",
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Options: []*discordgo.ApplicationCommandOption{
+				cabinetOption(),
+			},
+		},
+		{
+			Name:        "next",
+			Description: "Switch to the next player in the queue",
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Options: []*discordgo.ApplicationCommandOption{
+				cabinetOption(),
+			},
+		},
+	},
+}
+
+func (h *CommandHandlerCtx) CommandQueue(s *discordgo.Session, i *discordgo.InteractionCreate) error {
+	sub := i.ApplicationCommandData().Options[0]
+	user := interactionUser(i)
+
+	cab, err := cabinetFor(i)
+	if err != nil {
+		return respondEphemeral(s, i, err.Error())
+	}
+
+	switch sub.Name {
+	case "join":
+		cardNum, err := resolveCardArg(user.ID, subCommandOptions(sub)["card"].StringValue())
+		if err != nil {
+			return respondEphemeral(s, i, fmt.Sprintf("Cannot join the queue: %v", err))
+		}
+		if err := h.svc.Validate(cab, cardNum); err != nil {
+			return respondEphemeral(s, i, fmt.Sprintf("Refusing to queue `%s`: %v", cardNum, err))
+		}
+		if err := h.allowCard(i, cab, cardNum); err != nil {
+			return respondEphemeral(s, i, fmt.Sprintf("Refusing to queue `%s`: %v", redactedCardNum(cardNum), err))
+		}
+
+		pos, err := queue.Join(&QueueEntry{
+			UserID:   user.ID,
+			Username: user.Username,
+			Cabinet:  cab.Name,
+			CardNum:  cardNum,
+			JoinedAt: time.Now(),
+		})
+		if err != nil {
+			return errors.Wrap(err, "failed to join the queue")
+		}
+
+		log.Println("queue:", user.Username, "joined", cab.Name, "at position", pos)
+		return respondText(s, i, fmt.Sprintf("<@%s> joined the queue of **%s** as **%s** at position **%d**", user.ID, cab.Name, cab.Cards.NameOf(cardNum), pos))
+	case "leave":
+		left, err := queue.Leave(user.ID, cab)
+		if err != nil {
+			return errors.Wrap(err, "failed to leave the queue")
+		}
+		if !left {
+			return respondEphemeral(s, i, fmt.Sprintf("You are not in the queue of **%s**.", cab.Name))
+		}
+
+		log.Println("queue:", user.Username, "left", cab.Name)
+		return respondEphemeral(s, i, fmt.Sprintf("You left the queue of **%s**.", cab.Name))
+	case "list":
+		entries := queue.ListFor(cab)
+		if len(entries) == 0 {
+			return respondEphemeral(s, i, fmt.Sprintf("The queue of **%s** is empty.", cab.Name))
+		}
+
+		lines := lo.Map(entries, func(e *QueueEntry, idx int) string {
+			return fmt.Sprintf("%d. <@%s> as **%s** (joined <t:%d:R>)", idx+1, e.UserID, cab.Cards.NameOf(e.CardNum), e.JoinedAt.Unix())
+		})
+		header := ""
+		if cabinets.Multiple() {
+			header = fmt.Sprintf("Queue of **%s**:\n", cab.Name)
+		}
+		return respondMessage(s, i, &discordgo.InteractionResponseData{
+			Content:         joinLines(header, lines),
+			AllowedMentions: &discordgo.MessageAllowedMentions{},
+		})
+	case "next":
+		if err := deferForCabinet(s, i, cab); err != nil {
+			return err
+		}
+
+		var cardName string
+		next, err := queue.Advance(cab, func(head *QueueEntry) (err error) {
+			cardName, err = h.svc.Switch(context.Background(), cab, user, head.CardNum)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if next == nil {
+			return respondEphemeral(s, i, fmt.Sprintf("The queue of **%s** is empty.", cab.Name))
+		}
+
+		return respondMessage(s, i, &discordgo.InteractionResponseData{
+			Content: fmt.Sprintf("<@%s> it's your turn! Switched active AIME on **%s** to **%s** (`%s`)", next.UserID, cab.Name, cardName, redactedCardNum(next.CardNum)),
+			AllowedMentions: &discordgo.MessageAllowedMentions{
+				Users: []string{next.UserID},
+			},
+		})
+	default:
+		return respondEphemeral(s, i, "Unknown subcommand")
+	}
+}
@@ -0,0 +1,207 @@
+// Package rating recomputes the maimai DX player rating from the rating lists
+// stored in mai2_profile_rating.
+//
+// The rating is the sum of the rating of the best 35 charts of older
+// versions (ratingList) and the best 15 charts of the current version
+// (newRatingList). The rating of a chart is
+//
+//	floor(constant * factor * min(achievement, 100.5%))
+//
+// where factor depends on the rank reached and constant is the chart's
+// internal level, which the game does not store and is read from a chart
+// table instead.
+package rating
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// Difficulty is the level column of a rating list entry.
+type Difficulty int
+
+const (
+	Basic Difficulty = iota
+	Advanced
+	Expert
+	Master
+	ReMaster
+)
+
+var (
+	difficultyNames  = []string{"BASIC", "ADVANCED", "EXPERT", "MASTER", "Re:MASTER"}
+	difficultyShorts = []string{"BAS", "ADV", "EXP", "MAS", "ReM"}
+)
+
+func (d Difficulty) String() string {
+	if d < 0 || int(d) >= len(difficultyNames) {
+		return fmt.Sprintf("LEVEL %d", int(d))
+	}
+	return difficultyNames[d]
+}
+
+// Short returns a three letter name of d.
+func (d Difficulty) Short() string {
+	if d < 0 || int(d) >= len(difficultyShorts) {
+		return fmt.Sprintf("L%02d", int(d))
+	}
+	return difficultyShorts[d]
+}
+
+const (
+	// AchievementScale is what 1% is in stored achievements: 1005000 is
+	// 100.5000%.
+	AchievementScale = 10000
+	// MaxAchievement is the achievement above which a chart rates no higher.
+	MaxAchievement = 1005000
+
+	// OldCount and NewCount are the sizes of the best lists of older and
+	// current version charts.
+	OldCount = 35
+	NewCount = 15
+)
+
+// Entry is one chart in a rating list.
+type Entry struct {
+	MusicID     int64      `json:"musicId"`
+	Difficulty  Difficulty `json:"level"`
+	RomVersion  int64      `json:"romVersion"`
+	Achievement int64      `json:"achievement"`
+}
+
+// ParseList decodes a ratingList or newRatingList column. An empty column is
+// an empty list.
+func ParseList(raw []byte) ([]*Entry, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+
+	var entries []*Entry
+	if err := json.Unmarshal(raw, &entries); err != nil {
+		return nil, errors.Wrap(err, "failed to decode rating list")
+	}
+	// The game pads lists with empty entries until enough charts are played.
+	filtered := entries[:0]
+	for _, e := range entries {
+		if e != nil && e.MusicID != 0 {
+			filtered = append(filtered, e)
+		}
+	}
+	return filtered, nil
+}
+
+// rankFactors are the multipliers of the lowest achievement of each rank, in
+// tenths, highest first. The entries just below SSS+, SSS, SS, S and A are
+// the reduced factors the game gives those exact scores.
+var rankFactors = []struct {
+	achievement int64
+	factor      int64
+}{
+	{1005000, 224},
+	{1004999, 222},
+	{1000000, 216},
+	{999999, 214},
+	{995000, 211},
+	{990000, 208},
+	{989999, 206},
+	{980000, 203},
+	{970000, 200},
+	{969999, 176},
+	{940000, 168},
+	{900000, 152},
+	{800000, 136},
+	{799999, 128},
+	{750000, 120},
+	{700000, 112},
+	{600000, 96},
+	{500000, 80},
+	{400000, 64},
+	{300000, 48},
+	{200000, 32},
+	{100000, 16},
+}
+
+// ChartRating returns the rating of a chart with the given constant, in
+// tenths (137 is 13.7), played to achievement.
+func ChartRating(constant, achievement int64) int64 {
+	achievement = min(achievement, MaxAchievement)
+	for _, r := range rankFactors {
+		if achievement >= r.achievement {
+			// constant and factor are in tenths, achievement in 1/10000 %.
+			return constant * r.factor * achievement / (10 * 10 * 100 * AchievementScale)
+		}
+	}
+	return 0
+}
+
+// Scored is an entry with its chart's constant and rating.
+type Scored struct {
+	*Entry
+	Title string
+	// Constant is in tenths. It is 0 and Rating is 0 if the chart is not in
+	// the table.
+	Constant int64
+	Rating   int64
+}
+
+// Known reports whether the chart's constant was found.
+func (s *Scored) Known() bool {
+	return s.Constant != 0
+}
+
+// Breakdown is a player rating split into its best lists.
+type Breakdown struct {
+	// Old are the best OldCount charts of older versions (B35), New the best
+	// NewCount of the current version (B15), highest rated first.
+	Old, New []*Scored
+	OldTotal int64
+	NewTotal int64
+	Total    int64
+	// Unknown is the number of charts missing from the table.
+	Unknown int
+}
+
+// Compute rates the entries of ratingList (old) and newRatingList (new).
+func Compute(table *ChartTable, old, new []*Entry) *Breakdown {
+	b := &Breakdown{}
+	b.Old, b.OldTotal = b.best(table, old, OldCount)
+	b.New, b.NewTotal = b.best(table, new, NewCount)
+	b.Total = b.OldTotal + b.NewTotal
+	return b
+}
+
+func (b *Breakdown) best(table *ChartTable, entries []*Entry, count int) ([]*Scored, int64) {
+	scored := make([]*Scored, 0, len(entries))
+	for _, e := range entries {
+		s := &Scored{Entry: e}
+		if chart, ok := table.Chart(e.MusicID); ok {
+			s.Title = chart.Title
+			s.Constant = chart.Constant(e.Difficulty)
+		}
+		if s.Known() {
+			s.Rating = ChartRating(s.Constant, e.Achievement)
+		} else {
+			b.Unknown++
+		}
+		scored = append(scored, s)
+	}
+
+	sort.SliceStable(scored, func(i, j int) bool {
+		if scored[i].Rating != scored[j].Rating {
+			return scored[i].Rating > scored[j].Rating
+		}
+		return scored[i].Achievement > scored[j].Achievement
+	})
+	if len(scored) > count {
+		scored = scored[:count]
+	}
+
+	var total int64
+	for _, s := range scored {
+		total += s.Rating
+	}
+	return scored, total
+}
@@ -0,0 +1,84 @@
+package rating
+
+import "testing"
+
+func TestChartRating(t *testing.T) {
+	tests := []struct {
+		name        string
+		constant    int64
+		achievement int64
+		want        int64
+	}{
+		{"SSS+ cap", 150, 1010000, 337},
+		{"SSS+", 150, 1005000, 337},
+		{"just below SSS+", 150, 1004999, 334},
+		{"SSS", 130, 1000000, 280},
+		{"just below SSS", 130, 999999, 278},
+		{"SS+", 130, 995000, 272},
+		{"SS", 130, 990000, 267},
+		{"just below SS", 130, 989999, 265},
+		{"S", 130, 970000, 252},
+		{"just below S", 130, 969999, 221},
+		{"A", 100, 800000, 108},
+		{"just below A", 100, 799999, 102},
+		{"lowest rank", 100, 100000, 1},
+		{"below every rank", 100, 99999, 0},
+	}
+	for _, tt := range tests {
+		if got := ChartRating(tt.constant, tt.achievement); got != tt.want {
+			t.Errorf("%s: ChartRating(%d, %d) = %d, want %d", tt.name, tt.constant, tt.achievement, got, tt.want)
+		}
+	}
+}
+
+func TestRankFactorsDescend(t *testing.T) {
+	for idx := 1; idx < len(rankFactors); idx++ {
+		prev, cur := rankFactors[idx-1], rankFactors[idx]
+		if cur.achievement >= prev.achievement || cur.factor >= prev.factor {
+			t.Errorf("rankFactors[%d] = %+v does not descend from %+v", idx, cur, prev)
+		}
+	}
+}
+
+func TestCompute(t *testing.T) {
+	table := &ChartTable{charts: make(map[int64]*Chart)}
+	var old, new []*Entry
+	// 40 old charts of 10.1 to 14.0 and 20 new charts of 12.1 to 14.0, all
+	// on MASTER.
+	for i := int64(1); i <= 40; i++ {
+		table.charts[i] = &Chart{MusicID: i, Constants: []int64{0, 0, 0, 100 + i}}
+		old = append(old, &Entry{MusicID: i, Difficulty: Master, Achievement: 1005000})
+	}
+	for i := int64(1); i <= 20; i++ {
+		id := 10000 + i
+		table.charts[id] = &Chart{MusicID: id, Constants: []int64{0, 0, 0, 120 + i}}
+		new = append(new, &Entry{MusicID: id, Difficulty: Master, Achievement: 1000000})
+	}
+	new = append(new, &Entry{MusicID: 99999, Difficulty: Master, Achievement: 1005000})
+
+	b := Compute(table, old, new)
+
+	if len(b.Old) != OldCount || len(b.New) != NewCount {
+		t.Fatalf("got %d old and %d new charts, want %d and %d", len(b.Old), len(b.New), OldCount, NewCount)
+	}
+	if b.Old[0].MusicID != 40 || b.Old[OldCount-1].MusicID != 6 {
+		t.Errorf("old charts run from %d to %d, want 40 to 6", b.Old[0].MusicID, b.Old[OldCount-1].MusicID)
+	}
+	if b.New[0].MusicID != 10020 || b.New[NewCount-1].MusicID != 10006 {
+		t.Errorf("new charts run from %d to %d, want 10020 to 10006", b.New[0].MusicID, b.New[NewCount-1].MusicID)
+	}
+
+	var wantOld, wantNew int64
+	for i := int64(6); i <= 40; i++ {
+		wantOld += ChartRating(100+i, 1005000)
+	}
+	for i := int64(6); i <= 20; i++ {
+		wantNew += ChartRating(120+i, 1000000)
+	}
+	if b.OldTotal != wantOld || b.NewTotal != wantNew || b.Total != wantOld+wantNew {
+		t.Errorf("totals = %d + %d = %d, want %d + %d = %d", b.OldTotal, b.NewTotal, b.Total, wantOld, wantNew, wantOld+wantNew)
+	}
+	if b.Unknown != 1 {
+		t.Errorf("Unknown = %d, want 1", b.Unknown)
+	}
+}
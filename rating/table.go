@@ -0,0 +1,82 @@
+package rating
+
+import (
+	"encoding/json"
+	"math"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// Chart is the constants of every difficulty of one music.
+type Chart struct {
+	MusicID int64
+	Title   string
+	// Constants are in tenths, indexed by Difficulty.
+	Constants []int64
+}
+
+// Constant returns the constant of d, or 0 if the music has no such chart.
+func (c *Chart) Constant(d Difficulty) int64 {
+	if d < 0 || int(d) >= len(c.Constants) {
+		return 0
+	}
+	return c.Constants[d]
+}
+
+// ChartTable is the chart constants, by music ID.
+type ChartTable struct {
+	charts map[int64]*Chart
+}
+
+// tableMusic is a music in a chart table file. The layout is the one of the
+// widely shared music_data.json: a list of
+//
+//	{"id": "11", "title": "...", "ds": [5.0, 7.0, 10.0, 12.7]}
+//
+// where ds are the constants from BASIC upwards. DX charts have IDs above
+// 10000, as in the game.
+type tableMusic struct {
+	ID    json.Number `json:"id"`
+	Title string      `json:"title"`
+	DS    []float64   `json:"ds"`
+}
+
+// LoadChartTable reads a chart table file.
+func LoadChartTable(path string) (*ChartTable, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read chart table")
+	}
+
+	var music []*tableMusic
+	if err := json.Unmarshal(b, &music); err != nil {
+		return nil, errors.Wrap(err, "failed to decode chart table")
+	}
+
+	t := &ChartTable{charts: make(map[int64]*Chart, len(music))}
+	for _, m := range music {
+		id, err := m.ID.Int64()
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid music id %q in chart table", m.ID)
+		}
+
+		chart := &Chart{MusicID: id, Title: m.Title, Constants: make([]int64, len(m.DS))}
+		for idx, ds := range m.DS {
+			chart.Constants[idx] = int64(math.Round(ds * 10))
+		}
+		t.charts[id] = chart
+	}
+	return t, nil
+}
+
+// Chart returns the music with musicID.
+func (t *ChartTable) Chart(musicID int64) (*Chart, bool) {
+	c, ok := t.charts[musicID]
+	return c, ok
+}
+
+// Len returns the number of musics in the table.
+func (t *ChartTable) Len() int {
+	return len(t.charts)
+}
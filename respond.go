@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/pkg/errors"
+)
+
+// CommandHandler handles an application command or autocomplete
+// interaction. A returned error is logged with a correlation ID and, for
+// commands, reported back to the user as an ephemeral error embed.
+type CommandHandler func(s *discordgo.Session, i *discordgo.InteractionCreate) error
+
+const errorEmbedColor = 0xe74c3c
+
+// maxMessageLength is Discord's limit on the content of a message.
+const maxMessageLength = 2000
+
+// joinLines puts lines below header, one per line, as far as they fit one
+// message. The lines left out are counted in a last "…and N more" line.
+func joinLines(header string, lines []string) string {
+	var sb strings.Builder
+	sb.WriteString(header)
+
+	// Leave room for the widest "more" line so it always fits.
+	reserve := len(moreLine(len(lines)))
+	for idx, line := range lines {
+		if idx < len(lines)-1 && sb.Len()+len(line)+1+reserve > maxMessageLength ||
+			sb.Len()+len(line)+1 > maxMessageLength {
+			sb.WriteString(moreLine(len(lines) - idx))
+			break
+		}
+		sb.WriteString(line)
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+func moreLine(n int) string {
+	return fmt.Sprintf("…and %d more\n", n)
+}
+
+// newCorrelationID returns a short random ID that ties an error shown to a
+// user to its log line.
+func newCorrelationID() string {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return "00000000"
+	}
+	return hex.EncodeToString(b)
+}
+
+// deferredInteractions holds the IDs of interactions acknowledged by
+// deferResponse. Their response is sent as a follow-up message.
+var deferredInteractions sync.Map
+
+// deferResponse acknowledges i right away, for handlers that may not answer
+// within Discord's 3 seconds. Discord shows the bot as thinking until the
+// handler responds; the response is then shown in place of that, and is
+// ephemeral if and only if ephemeral is set here.
+func deferResponse(s *discordgo.Session, i *discordgo.InteractionCreate, ephemeral bool) error {
+	data := &discordgo.InteractionResponseData{}
+	if ephemeral {
+		data.Flags = discordgo.MessageFlagsEphemeral
+	}
+	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
+		Data: data,
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to defer interaction response")
+	}
+
+	deferredInteractions.Store(i.ID, true)
+	return nil
+}
+
+// deferForCabinet defers the response if cab's aime.txt is behind an agent,
+// where a read or write may take up to agentCallTimeout.
+func deferForCabinet(s *discordgo.Session, i *discordgo.InteractionCreate, cab *Cabinet) error {
+	if _, remote := cab.Aime.(*RemoteAimeTxt); !remote {
+		return nil
+	}
+	return deferResponse(s, i, false)
+}
+
+func respondMessage(s *discordgo.Session, i *discordgo.InteractionCreate, data *discordgo.InteractionResponseData) error {
+	if _, ok := deferredInteractions.LoadAndDelete(i.ID); ok {
+		_, err := s.FollowupMessageCreate(i.Interaction, true, &discordgo.WebhookParams{
+			Content:         data.Content,
+			Embeds:          data.Embeds,
+			AllowedMentions: data.AllowedMentions,
+			Flags:           data.Flags,
+		})
+		return errors.Wrap(err, "failed to send deferred response")
+	}
+
+	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: data,
+	})
+	return errors.Wrap(err, "failed to respond to interaction")
+}
+
+func respondText(s *discordgo.Session, i *discordgo.InteractionCreate, content string) error {
+	return respondMessage(s, i, &discordgo.InteractionResponseData{
+		Content: content,
+	})
+}
+
+func respondEphemeral(s *discordgo.Session, i *discordgo.InteractionCreate, content string) error {
+	return respondMessage(s, i, &discordgo.InteractionResponseData{
+		Content: content,
+		Flags:   discordgo.MessageFlagsEphemeral,
+	})
+}
+
+func respondAutocomplete(s *discordgo.Session, i *discordgo.InteractionCreate, choices []*discordgo.ApplicationCommandOptionChoice) error {
+	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionApplicationCommandAutocompleteResult,
+		Data: &discordgo.InteractionResponseData{
+			Choices: choices,
+		},
+	})
+	return errors.Wrap(err, "failed to respond to autocomplete")
+}
+
+func respondError(s *discordgo.Session, i *discordgo.InteractionCreate, correlationID string, cause error) error {
+	return respondMessage(s, i, &discordgo.InteractionResponseData{
+		Flags: discordgo.MessageFlagsEphemeral,
+		Embeds: []*discordgo.MessageEmbed{
+			{
+				Title:       "Something went wrong",
+				Description: cause.Error(),
+				Color:       errorEmbedColor,
+				Footer: &discordgo.MessageEmbedFooter{
+					Text: fmt.Sprintf("Error ID: %s", correlationID),
+				},
+			},
+		},
+	})
+}
+
+// runHandler calls handler and reports its error or panic. Errors in
+// autocomplete handlers are only logged, as Discord has no way to show
+// them.
+func runHandler(name string, handler CommandHandler, s *discordgo.Session, i *discordgo.InteractionCreate) {
+	defer deferredInteractions.Delete(i.ID)
+
+	var err error
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				err = errors.Errorf("internal error: %v", r)
+			}
+		}()
+		err = handler(s, i)
+	}()
+	if err == nil {
+		return
+	}
+
+	correlationID := newCorrelationID()
+	log.Printf("[%s] %s: %s failed for %s: %v", correlationID, interactionKind(i), name, interactionUser(i).Username, err)
+
+	if i.Type == discordgo.InteractionApplicationCommandAutocomplete {
+		return
+	}
+
+	if err := respondError(s, i, correlationID, err); err != nil {
+		log.Printf("[%s] failed to report error to user: %v", correlationID, err)
+	}
+}
+
+func interactionKind(i *discordgo.InteractionCreate) string {
+	if i.Type == discordgo.InteractionApplicationCommandAutocomplete {
+		return "autocomplete"
+	}
+	return "command"
+}
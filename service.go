@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/gen2brain/beeep"
+)
+
+// CardService reads and switches the active card of a cabinet. It is shared
+// by the Discord commands, the session manager and the HTTP API.
+type CardService struct {
+	requireRegistered bool
+
+	mu       sync.Mutex
+	onSwitch []func(cab *Cabinet)
+}
+
+func NewCardService(requireRegistered bool) *CardService {
+	return &CardService{requireRegistered: requireRegistered}
+}
+
+// OnSwitch registers fn to be called after every successful switch.
+func (s *CardService) OnSwitch(fn func(cab *Cabinet)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.onSwitch = append(s.onSwitch, fn)
+}
+
+// RegisteredCard is an entry of a cabinet's record.txt.
+type RegisteredCard struct {
+	Name    string
+	CardNum string
+}
+
+// Cards returns the cards registered on cab, sorted by name.
+func (s *CardService) Cards(cab *Cabinet) []RegisteredCard {
+	snapshot := cab.Cards.Snapshot()
+	list := make([]RegisteredCard, 0, len(snapshot))
+	for name, cardNum := range snapshot {
+		list = append(list, RegisteredCard{Name: name, CardNum: cardNum})
+	}
+	sort.Slice(list, func(a, b int) bool { return list[a].Name < list[b].Name })
+	return list
+}
+
+// Current returns the active card of cab and its registered name.
+func (s *CardService) Current(ctx context.Context, cab *Cabinet) (cardNum, cardName string, err error) {
+	cardNum, err = cab.Aime.Read(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	return cardNum, cab.Cards.NameOf(cardNum), nil
+}
+
+// Validate checks that cardNum may be written to cab's aime.txt. With
+// --require-registered-card it must also be registered on cab.
+func (s *CardService) Validate(cab *Cabinet, cardNum string) error {
+	var registry *CardRegistry
+	if s.requireRegistered {
+		registry = cab.Cards
+	}
+	return ValidateAccessCode(cardNum, registry)
+}
+
+// Switch writes cardNum to cab's aime.txt on behalf of user, records the
+// switch in the history and raises a desktop notification. It returns the
+// registered name of the card. cardNum is expected to be validated already.
+// Nothing is recorded if the write fails. Switches of the same cabinet run
+// one at a time.
+func (s *CardService) Switch(ctx context.Context, cab *Cabinet, user *discordgo.User, cardNum string) (string, error) {
+	cab.switchMu.Lock()
+	defer cab.switchMu.Unlock()
+
+	return s.switchLocked(ctx, cab, user, cardNum)
+}
+
+// SwitchIf is Switch, but only switches if ok, which is checked once no other
+// switch of cab can run anymore. It reports whether it switched.
+func (s *CardService) SwitchIf(ctx context.Context, cab *Cabinet, user *discordgo.User, cardNum string, ok func() bool) (string, bool, error) {
+	cab.switchMu.Lock()
+	defer cab.switchMu.Unlock()
+
+	if !ok() {
+		return "", false, nil
+	}
+	cardName, err := s.switchLocked(ctx, cab, user, cardNum)
+	return cardName, err == nil, err
+}
+
+func (s *CardService) switchLocked(ctx context.Context, cab *Cabinet, user *discordgo.User, cardNum string) (string, error) {
+	prevCardNum, err := cab.Aime.Read(ctx)
+	if err != nil {
+		log.Println("switch: failed to read previous card:", err)
+	}
+
+	// write to aime.txt
+	if err := cab.Aime.Write(ctx, cardNum); err != nil {
+		return "", err
+	}
+
+	cardName := cab.Cards.NameOf(cardNum)
+
+	now := time.Now()
+	recentSwitches.Touch(cardNum, now)
+	if cab.Sessions != nil {
+		cab.Sessions.Begin(cardNum, now)
+	}
+
+	if err := history.Append(&HistoryEntry{
+		Time:         now,
+		Cabinet:      cab.Name,
+		UserID:       user.ID,
+		Username:     user.Username,
+		PrevCardNum:  prevCardNum,
+		PrevCardName: cab.Cards.NameOf(prevCardNum),
+		CardNum:      cardNum,
+		CardName:     cardName,
+	}); err != nil {
+		log.Println("switch: failed to record history:", err)
+	}
+
+	message := fmt.Sprintf("Switched active AIME on **%s** to **%s** (`%s`)", cab.Name, cardName, cardNum)
+
+	log.Println(message, "by", user.Username)
+
+	// The notification can take a while to show, so it does not hold up the
+	// reply to the switch.
+	go func() {
+		if err := beeep.Notify(fmt.Sprintf("%s AIME Switched", cab.Name), message, ""); err != nil {
+			log.Println("switch: failed to show desktop notification:", err)
+		}
+	}()
+
+	s.mu.Lock()
+	listeners := s.onSwitch
+	s.mu.Unlock()
+	for _, fn := range listeners {
+		fn(cab)
+	}
+
+	return cardName, nil
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/pkg/errors"
+)
+
+// sessionCheckInterval is how often the session manager checks whether the
+// active card should be reverted.
+const sessionCheckInterval = 15 * time.Second
+
+// autoRevertUser is recorded in the switch history for automatic reverts.
+var autoRevertUser = &discordgo.User{Username: "auto-revert"}
+
+// SessionManager reverts a cabinet's aime.txt to a guest card once a
+// player's session is over: either a fixed time after the switch, or once
+// the DB shows no new play for a while.
+type SessionManager struct {
+	h   *CommandHandlerCtx
+	dg  *discordgo.Session
+	cab *Cabinet
+
+	guestCard   string
+	timeout     time.Duration
+	idleTimeout time.Duration
+	channelID   string
+
+	mu            sync.Mutex
+	cardNum       string
+	switchedAt    time.Time
+	lastPlayAt    time.Time
+	lastPlayCount int64
+}
+
+// NewSessionManager returns nil if no guest card or timeout is configured.
+func NewSessionManager(h *CommandHandlerCtx, dg *discordgo.Session, cab *Cabinet) (*SessionManager, error) {
+	guestCard := h.c.String("guest-card")
+	timeout := h.c.Duration("session-timeout")
+	idleTimeout := h.c.Duration("session-idle-timeout")
+	if guestCard == "" || (timeout <= 0 && idleTimeout <= 0) {
+		return nil, nil
+	}
+
+	if err := ValidateAccessCode(guestCard, nil); err != nil {
+		return nil, errors.Wrap(err, "invalid guest card")
+	}
+
+	return &SessionManager{
+		h:           h,
+		dg:          dg,
+		cab:         cab,
+		guestCard:   guestCard,
+		timeout:     timeout,
+		idleTimeout: idleTimeout,
+		channelID:   h.c.String("notify-channel"),
+	}, nil
+}
+
+// Begin starts or restarts the session timer for cardNum. Switching to the
+// guest card ends the session.
+func (m *SessionManager) Begin(cardNum string, at time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.cardNum = cardNum
+	m.switchedAt = at
+	m.lastPlayAt = time.Time{}
+}
+
+// ObserveProfiles records play activity from a DB snapshot. Any increase
+// of the total play count counts as a play of the active card.
+func (m *SessionManager) ObserveProfiles(profiles []*PlayerProfile) {
+	var total int64
+	for _, p := range profiles {
+		total += p.PlayCount
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.lastPlayCount != 0 && total != m.lastPlayCount {
+		m.lastPlayAt = time.Now()
+	}
+	m.lastPlayCount = total
+}
+
+// sessionState identifies a session: the card and when it was switched to.
+type sessionState struct {
+	cardNum    string
+	switchedAt time.Time
+}
+
+// expired returns why the current session should end, or "" if it should
+// not, and the session it looked at.
+func (m *SessionManager) expired(now time.Time) (string, sessionState) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.expiredLocked(now), m.stateLocked()
+}
+
+func (m *SessionManager) stateLocked() sessionState {
+	return sessionState{cardNum: m.cardNum, switchedAt: m.switchedAt}
+}
+
+func (m *SessionManager) expiredLocked(now time.Time) string {
+	if m.cardNum == "" || m.cardNum == m.guestCard {
+		return ""
+	}
+
+	if m.timeout > 0 && now.Sub(m.switchedAt) >= m.timeout {
+		return fmt.Sprintf("session timed out after %s", m.timeout)
+	}
+
+	if m.idleTimeout > 0 {
+		lastActive := m.switchedAt
+		if m.lastPlayAt.After(lastActive) {
+			lastActive = m.lastPlayAt
+		}
+		if now.Sub(lastActive) >= m.idleTimeout {
+			return fmt.Sprintf("no play for %s", m.idleTimeout)
+		}
+	}
+
+	return ""
+}
+
+func (m *SessionManager) Start(ctx context.Context) {
+	log.Println("session:", m.cab.Name, "auto-revert to guest card enabled, timeout:", m.timeout, "idle timeout:", m.idleTimeout)
+
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(sessionCheckInterval):
+			}
+
+			reason, session := m.expired(time.Now())
+			if reason == "" {
+				continue
+			}
+
+			m.revert(reason, session)
+		}
+	}()
+}
+
+// revert switches to the guest card unless session was replaced by a switch
+// since expired saw it.
+func (m *SessionManager) revert(reason string, session sessionState) {
+	_, switched, err := m.h.svc.SwitchIf(context.Background(), m.cab, autoRevertUser, m.guestCard, func() bool {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		current := m.stateLocked()
+		return current.cardNum == session.cardNum && current.switchedAt.Equal(session.switchedAt)
+	})
+	if err != nil {
+		log.Println("session: failed to revert to guest card:", err)
+		return
+	}
+	if !switched {
+		log.Println("session:", m.cab.Name, "card switched meanwhile, not reverting")
+		return
+	}
+
+	message := fmt.Sprintf("Active AIME on **%s** was reset from **%s** to the guest card: %s", m.cab.Name, m.cab.Cards.NameOf(session.cardNum), reason)
+	log.Println("session:", message)
+
+	if m.channelID == "" {
+		return
+	}
+	if _, err := m.dg.ChannelMessageSend(m.channelID, message); err != nil {
+		log.Println("session: failed to post revert notice:", err)
+	}
+}
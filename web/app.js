@@ -0,0 +1,134 @@
+// The API token comes from ?token= (handy for a TV bookmark) or the login
+// form, and is remembered in localStorage.
+const params = new URLSearchParams(location.search);
+if (params.has("token")) {
+  localStorage.setItem("aimeswitcher-token", params.get("token"));
+  history.replaceState(null, "", location.pathname);
+}
+
+let token = localStorage.getItem("aimeswitcher-token");
+let events = null;
+
+const $ = (id) => document.getElementById(id);
+
+function setStatus(text, ok) {
+  $("status").textContent = text;
+  $("status").classList.toggle("ok", ok);
+}
+
+function connect() {
+  if (events) {
+    events.close();
+  }
+  if (!token) {
+    $("login").hidden = false;
+    setStatus("not connected", false);
+    return;
+  }
+
+  events = new EventSource("api/v1/events?token=" + encodeURIComponent(token));
+  events.addEventListener("state", (e) => {
+    $("login").hidden = true;
+    setStatus("live", true);
+    render(JSON.parse(e.data));
+  });
+  events.onerror = () => {
+    setStatus("reconnecting…", false);
+    if (events.readyState === EventSource.CLOSED) {
+      // EventSource gives up on any error response without saying which.
+      checkToken();
+    }
+  };
+}
+
+// checkToken asks for the login again if the server rejects the token, and
+// otherwise reconnects after a while, e.g. when the bot was restarting.
+async function checkToken() {
+  const resp = await fetch("api/v1/cabinets", {
+    headers: { "Authorization": "Bearer " + token },
+  }).catch(() => null);
+  if (resp && resp.status === 401) {
+    localStorage.removeItem("aimeswitcher-token");
+    token = null;
+    connect();
+    return;
+  }
+  setTimeout(connect, 5000);
+}
+
+async function switchCard(cabinet, name) {
+  if (!confirm(`Switch ${cabinet} to ${name}?`)) {
+    return;
+  }
+
+  const resp = await fetch("api/v1/switch?cabinet=" + encodeURIComponent(cabinet), {
+    method: "POST",
+    headers: {
+      "Authorization": "Bearer " + token,
+      "Content-Type": "application/json",
+    },
+    body: JSON.stringify({ name: name, by: "dashboard" }),
+  });
+  if (!resp.ok) {
+    const body = await resp.json().catch(() => ({ error: resp.statusText }));
+    alert("Switch failed: " + body.error);
+  }
+}
+
+function render(state) {
+  const main = $("cabinets");
+  main.replaceChildren();
+
+  for (const cab of state.cabinets) {
+    const node = $("cabinet-template").content.cloneNode(true);
+    node.querySelector(".cabinet-name").textContent = cab.game && cab.game !== cab.name ? `${cab.name} (${cab.game})` : cab.name;
+    node.querySelector(".card-name").textContent = cab.cardName;
+    node.querySelector(".card-num").textContent = cab.cardNum;
+
+    if (cab.error) {
+      const error = node.querySelector(".error");
+      error.textContent = cab.error;
+      error.hidden = false;
+    }
+
+    const players = node.querySelector(".players");
+    for (const name of cab.players || []) {
+      const button = document.createElement("button");
+      button.textContent = name;
+      button.classList.toggle("active", name === cab.cardName);
+      button.addEventListener("click", () => switchCard(cab.name, name));
+      players.append(button);
+    }
+
+    const tbody = node.querySelector(".leaderboard");
+    (cab.leaderboard || []).forEach((line, idx) => {
+      const tr = document.createElement("tr");
+      for (const value of [idx + 1, line.userName, line.rating, line.playCount, line.lastPlayDate]) {
+        const td = document.createElement("td");
+        td.textContent = value;
+        tr.append(td);
+      }
+      tbody.append(tr);
+    });
+
+    main.append(node);
+  }
+
+  const queue = $("queue");
+  queue.replaceChildren();
+  for (const entry of state.queue) {
+    const li = document.createElement("li");
+    li.textContent = state.cabinets.length > 1 ? `${entry.username} as ${entry.cardName} on ${entry.cabinet}` : `${entry.username} as ${entry.cardName}`;
+    queue.append(li);
+  }
+  $("queue-empty").hidden = state.queue.length > 0;
+}
+
+$("login").addEventListener("submit", (e) => {
+  e.preventDefault();
+  token = $("token").value;
+  localStorage.setItem("aimeswitcher-token", token);
+  connect();
+});
+
+connect();